@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+// handleHealthz 只要进程还能处理请求就返回 200
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	sendJSONResponse(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz 在启动完成、未进入关机流程且 uploads 目录可用时返回 200，否则返回 503 及原因
+func (h *Hub) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	var problems []string
+	if atomic.LoadInt32(&h.serverReady) == 0 {
+		problems = append(problems, "starting up")
+	}
+	if atomic.LoadInt32(&h.shuttingDown) == 1 {
+		problems = append(problems, "shutting down")
+	}
+	if fi, err := os.Stat(h.uploadsDir); err != nil || !fi.IsDir() {
+		problems = append(problems, "uploads directory unavailable")
+	}
+	h.filesMu.Lock()
+	budgetFull := h.uploadLimits.DiskBudget > 0 && h.diskUsage >= h.uploadLimits.DiskBudget
+	h.filesMu.Unlock()
+	if budgetFull {
+		problems = append(problems, "disk budget exhausted")
+	}
+
+	if len(problems) > 0 {
+		sendJSONResponse(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "reason": strings.Join(problems, "; ")})
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// checkAdminPassword accepts the password as HTTP basic auth (any user name) or as a bearer token.
+func (h *Hub) checkAdminPassword(r *http.Request) bool {
+	given, ok := "", false
+	if _, pass, basic := r.BasicAuth(); basic {
+		given, ok = pass, true
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		given, ok = strings.TrimPrefix(auth, "Bearer "), true
+	}
+	if !ok {
+		return false
+	}
+	// 比较摘要而不是原文，避免长度不同时提前返回泄露信息
+	a, b := sha256.Sum256([]byte(given)), sha256.Sum256([]byte(h.adminPassword))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// withAdmin protects an admin handler with the configured password.
+func (h *Hub) withAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.adminPassword == "" {
+			sendJSONError(w, "Admin API is disabled; set an admin password to enable it", http.StatusNotFound)
+			return
+		}
+		if !h.checkAdminPassword(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="chatroom admin"`)
+			sendJSONError(w, "Invalid admin password", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+type adminSession struct {
+	Nickname       string    `json:"nickname"`
+	ClientID       string    `json:"clientID"`
+	LastSeen       time.Time `json:"lastSeen"`
+	Connected      bool      `json:"connected"`
+	Rooms          []string  `json:"rooms,omitempty"`
+	QueuedMessages int       `json:"queuedMessages"`
+	UploadedBytes  int64     `json:"uploadedBytes"`
+	Fingerprint    string    `json:"fingerprint"`
+	IP             string    `json:"ip,omitempty"`
+	Moderator      bool      `json:"moderator,omitempty"`
+	Muted          bool      `json:"muted,omitempty"`
+}
+
+type adminUpload struct {
+	UUID         string    `json:"uuid"`
+	Owner        string    `json:"owner"`
+	Committed    int64     `json:"committed"`
+	Finished     bool      `json:"finished"`
+	CreatedAt    time.Time `json:"createdAt"`
+	LastActivity time.Time `json:"lastActivity"`
+}
+
+type adminFileReference struct {
+	Sender    string `json:"sender"`
+	Recipient string `json:"recipient,omitempty"`
+	Room      string `json:"room,omitempty"`
+}
+
+type adminFile struct {
+	UUID         string               `json:"uuid"`
+	Path         string               `json:"path"`
+	Owner        string               `json:"owner,omitempty"`
+	References   []adminFileReference `json:"references"`
+	Downloads    int                  `json:"downloads"`
+	MaxDownloads int                  `json:"maxDownloads,omitempty"`
+	ExpiresAt    *time.Time           `json:"expiresAt,omitempty"`
+	Gone         bool                 `json:"gone"`
+}
+
+type adminStatus struct {
+	Version   string         `json:"version"`
+	GoVersion string         `json:"goVersion"`
+	StartedAt time.Time      `json:"startedAt"`
+	Uptime    string         `json:"uptime"`
+	Clients   int            `json:"clients"`
+	DiskUsage int64          `json:"diskUsage"`
+	Sessions  []adminSession `json:"sessions"`
+	Uploads   []adminUpload  `json:"uploads"`
+	Files     []adminFile    `json:"files"`
+	Bans      []Ban          `json:"bans"`
+}
+
+// handleAdminStatus 返回会话、进行中的上传和文件登记的快照
+func (h *Hub) handleAdminStatus(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	h.filesMu.Lock()
+	status := adminStatus{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		StartedAt: h.startTime,
+		Uptime:    time.Since(h.startTime).Round(time.Second).String(),
+		Clients:   len(h.clients),
+		DiskUsage: h.diskUsage,
+		Sessions:  make([]adminSession, 0, len(h.sessions)),
+		Uploads:   make([]adminUpload, 0, len(h.uploads)),
+		Files:     make([]adminFile, 0, len(h.fileRegistry)),
+		Bans:      make([]Ban, 0, len(h.bans)),
+	}
+	for _, s := range h.sessions {
+		status.Sessions = append(status.Sessions, adminSession{
+			Nickname:       s.Nickname,
+			ClientID:       s.ClientID,
+			LastSeen:       s.LastSeen,
+			Connected:      s.Client != nil,
+			Rooms:          h.roomsOfLocked(s.ClientID),
+			QueuedMessages: len(s.Mailbox),
+			UploadedBytes:  h.uploadedBytes[s.ClientID],
+			Fingerprint:    publicKeyFingerprint(s.PublicKey),
+			IP:             s.IP,
+			Moderator:      s.Client != nil && s.Client.moderator,
+			Muted:          h.isMutedLocked(s.ClientID),
+		})
+	}
+	for _, u := range h.uploads {
+		status.Uploads = append(status.Uploads, adminUpload{
+			UUID: u.UUID, Owner: u.Owner, Committed: u.Committed, Finished: u.Finished,
+			CreatedAt: u.CreatedAt, LastActivity: u.LastActivity,
+		})
+	}
+	for uuid, info := range h.fileRegistry {
+		file := adminFile{
+			UUID: uuid, Path: info.Path, Owner: info.Owner, References: []adminFileReference{},
+			Downloads: info.Downloads, MaxDownloads: info.MaxDownloads, Gone: info.Gone,
+		}
+		if !info.ExpiresAt.IsZero() {
+			expiresAt := info.ExpiresAt
+			file.ExpiresAt = &expiresAt
+		}
+		for _, ref := range info.References {
+			file.References = append(file.References, adminFileReference{Sender: ref.Sender, Recipient: ref.Recipient, Room: ref.Room})
+		}
+		status.Files = append(status.Files, file)
+	}
+	for _, ban := range h.bans {
+		status.Bans = append(status.Bans, *ban)
+	}
+	h.filesMu.Unlock()
+	h.mutex.Unlock()
+
+	sort.Slice(status.Sessions, func(i, j int) bool { return status.Sessions[i].Nickname < status.Sessions[j].Nickname })
+	sort.Slice(status.Uploads, func(i, j int) bool { return status.Uploads[i].CreatedAt.Before(status.Uploads[j].CreatedAt) })
+	sort.Slice(status.Files, func(i, j int) bool { return status.Files[i].UUID < status.Files[j].UUID })
+	sendJSONResponse(w, http.StatusOK, status)
+}
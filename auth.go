@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// 注册时的持钥证明：服务器用客户端声明的公钥加密一个随机 nonce，
+// 只有持有对应私钥的客户端才能解密并原样返回，之后才会绑定会话。
+const challengeTimeout = 30 * time.Second
+
+type pendingRegistration struct {
+	request  Message
+	nonce    string
+	issuedAt time.Time
+}
+
+func parseRSAPublicKey(pemKey string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errors.New("public key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an RSA key")
+	}
+	return pub, nil
+}
+
+// startRegistration 校验注册请求并下发加密的挑战
+func (h *Hub) startRegistration(client *Client, msg Message) {
+	h.mutex.Lock()
+	registered := client.clientID != "" || client.pending != nil
+	session, exists := h.sessions[msg.ClientID]
+	h.mutex.Unlock()
+	if registered {
+		sendError(client, msg, errInvalidRequest, "已经注册或正在注册")
+		return
+	}
+	if msg.ClientID == "" {
+		rejectRegistration(client, "缺少 ClientID")
+		return
+	}
+	protocol, ok := negotiateVersion(msg.Version)
+	if !ok {
+		sendError(client, msg, errUnsupportedVersion, "不支持的协议版本")
+		rejectRegistration(client, "不支持的协议版本")
+		return
+	}
+	h.mutex.Lock()
+	client.protocol = protocol
+	h.mutex.Unlock()
+	if exists && session.PublicKey != msg.PublicKey {
+		log.Printf("ClientID hijacking attempt! ID: %s", msg.ClientID)
+		rejectRegistration(client, "该 ClientID 已绑定到其他公钥")
+		return
+	}
+	pub, err := parseRSAPublicKey(msg.PublicKey)
+	if err != nil {
+		log.Printf("Rejecting registration for %s: %v", msg.ClientID, err)
+		rejectRegistration(client, "公钥无效")
+		return
+	}
+	h.mutex.Lock()
+	ban := h.activeBanLocked(msg.ClientID, publicKeyFingerprint(msg.PublicKey), client.ip)
+	h.mutex.Unlock()
+	if ban != nil {
+		log.Printf("Rejecting banned client %s from %s", msg.ClientID, client.ip)
+		rejectRegistration(client, banReason(ban))
+		return
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		rejectRegistration(client, "服务器无法生成挑战")
+		return
+	}
+	nonce := hex.EncodeToString(b)
+	ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, pub, []byte(nonce))
+	if err != nil {
+		log.Printf("Could not encrypt challenge for %s: %v", msg.ClientID, err)
+		rejectRegistration(client, "公钥无效")
+		return
+	}
+
+	h.mutex.Lock()
+	client.pending = &pendingRegistration{request: msg, nonce: nonce, issuedAt: time.Now()}
+	h.mutex.Unlock()
+
+	response := map[string]string{"type": "challenge", "data": base64.StdEncoding.EncodeToString(ciphertext)}
+	if msgBytes, err := json.Marshal(response); err == nil {
+		sendMessageToClient(client, msgBytes)
+	}
+}
+
+// handleChallengeResponse 校验客户端解密出的 nonce，成功后才真正完成注册
+func (h *Hub) handleChallengeResponse(client *Client, msg Message) {
+	h.mutex.Lock()
+	pending := client.pending
+	client.pending = nil
+	h.mutex.Unlock()
+	if pending == nil {
+		sendError(client, msg, errInvalidRequest, "没有待回答的挑战")
+		return
+	}
+	if time.Since(pending.issuedAt) > challengeTimeout {
+		rejectRegistration(client, "挑战已过期")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(msg.Data), []byte(pending.nonce)) != 1 {
+		log.Printf("Failed proof-of-possession for ClientID %s", pending.request.ClientID)
+		rejectRegistration(client, "身份验证失败")
+		return
+	}
+	h.completeRegistration(client, pending.request)
+}
+
+// rejectRegistration sends a registerError and closes the connection once it has been written.
+func rejectRegistration(client *Client, reason string) {
+	disconnectClient(client, "registerError", reason)
+}
+
+// --- HTTP 会话令牌：注册成功后下发，上传/下载接口凭此识别调用者 ---
+const (
+	sessionTokenHeader = "X-Session-Token"
+	// 会话断开后令牌仍保留的宽限期，避免短暂重连打断进行中的传输
+	tokenGracePeriod = 2 * time.Minute
+)
+
+// requester identifies the session behind an authenticated HTTP request.
+type requester struct {
+	ClientID string
+	Nickname string
+}
+
+// rotateSessionTokenLocked issues a fresh token for the session, revoking the old one. Caller must hold mutex.
+func (h *Hub) rotateSessionTokenLocked(session *Session) {
+	if session.Token != "" {
+		delete(h.sessionTokens, session.Token)
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Could not generate session token for %s: %v", session.ClientID, err)
+		session.Token = ""
+		return
+	}
+	session.Token = hex.EncodeToString(b)
+	h.sessionTokens[session.Token] = session.ClientID
+}
+
+// revokeSessionTokenLocked removes the session's token. Caller must hold mutex.
+func (h *Hub) revokeSessionTokenLocked(session *Session) {
+	if session.Token != "" {
+		delete(h.sessionTokens, session.Token)
+		session.Token = ""
+	}
+}
+
+func (h *Hub) authenticateRequest(r *http.Request) (requester, bool) {
+	token := r.Header.Get(sessionTokenHeader)
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return requester{}, false
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	clientID, ok := h.sessionTokens[token]
+	if !ok {
+		return requester{}, false
+	}
+	session, ok := h.sessions[clientID]
+	if !ok || session.Token != token {
+		return requester{}, false
+	}
+	if session.Client == nil && time.Since(session.LastSeen) > tokenGracePeriod {
+		return requester{}, false
+	}
+	return requester{ClientID: session.ClientID, Nickname: session.Nickname}, true
+}
+
+// withSession rejects requests that do not carry a valid session token.
+func (h *Hub) withSession(next func(http.ResponseWriter, *http.Request, requester)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		who, ok := h.authenticateRequest(r)
+		if !ok {
+			sendJSONError(w, "Missing or invalid session token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r, who)
+	}
+}
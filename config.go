@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 配置：默认值 < 配置文件 (JSON) < CHATROOM_* 环境变量 < 命令行参数。
+// 每个命令行参数都对应一个环境变量，例如 -max-file-size 对应 CHATROOM_MAX_FILE_SIZE。
+const configEnvPrefix = "CHATROOM_"
+
+// Duration is a time.Duration written as "30s" or "5m" in the config file and on the command line.
+type Duration time.Duration
+
+func (d Duration) String() string { return time.Duration(d).String() }
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) { return json.Marshal(d.String()) }
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	return d.Set(s)
+}
+
+type Config struct {
+	Port            string   `json:"port"`
+	UploadsDir      string   `json:"uploadsDir"`
+	StaticDir       string   `json:"staticDir"`
+	History         string   `json:"history"`
+	HistorySize     int      `json:"historySize"`
+	HistoryFile     string   `json:"historyFile"`
+	Persist         bool     `json:"persist"`
+	StateFile       string   `json:"stateFile"`
+	SessionTimeout  Duration `json:"sessionTimeout"`
+	WriteWait       Duration `json:"writeWait"`
+	SendBuffer      int      `json:"sendBuffer"`
+	ReadTimeout     Duration `json:"readTimeout"`
+	WriteTimeout    Duration `json:"writeTimeout"`
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+	PingInterval    Duration `json:"pingInterval"`
+	PongTimeout     Duration `json:"pongTimeout"`
+
+	MaxFileSize          int64    `json:"maxFileSize"`
+	MaxUploadsPerSession int      `json:"maxUploadsPerSession"`
+	SessionQuota         int64    `json:"sessionQuota"`
+	DiskBudget           int64    `json:"diskBudget"`
+	UploadTTL            Duration `json:"uploadTTL"`
+	OrphanTTL            Duration `json:"orphanTTL"`
+	JanitorInterval      Duration `json:"janitorInterval"`
+
+	TLSCert       string `json:"tlsCert"`
+	TLSKey        string `json:"tlsKey"`
+	TLSSelfSigned bool   `json:"tlsSelfSigned"`
+	TLSDir        string `json:"tlsDir"`
+	TLSHosts      string `json:"tlsHosts"`
+
+	AdminPassword   string `json:"adminPassword"`
+	ModeratorSecret string `json:"moderatorSecret"`
+	ModeratorKeys   string `json:"moderatorKeys"`
+
+	MaxFrameSize  int64     `json:"maxFrameSize"`
+	RateFrames    RateLimit `json:"rateFrames"`
+	RateMessages  RateLimit `json:"rateMessages"`
+	RateNickname  RateLimit `json:"rateNickname"`
+	RateFileShare RateLimit `json:"rateFileShare"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Port:            "5000",
+		UploadsDir:      "./uploads",
+		StaticDir:       "./static",
+		History:         "none",
+		HistorySize:     1000,
+		HistoryFile:     "history.log",
+		StateFile:       "chatroom-state.json",
+		SessionTimeout:  Duration(5 * time.Minute),
+		WriteWait:       Duration(10 * time.Second),
+		SendBuffer:      256,
+		ReadTimeout:     Duration(10 * time.Minute),
+		WriteTimeout:    Duration(10 * time.Minute),
+		ShutdownTimeout: Duration(30 * time.Second),
+		PingInterval:    Duration(25 * time.Second),
+		PongTimeout:     Duration(60 * time.Second),
+
+		MaxFileSize:          2 << 30, // 2 GiB
+		MaxUploadsPerSession: 3,
+		SessionQuota:         5 << 30,  // 5 GiB
+		DiskBudget:           20 << 30, // 20 GiB
+		UploadTTL:            Duration(time.Hour),
+		OrphanTTL:            Duration(10 * time.Minute),
+		JanitorInterval:      Duration(time.Minute),
+
+		TLSDir: "./tls",
+
+		MaxFrameSize:  1 << 20, // 1 MiB
+		RateFrames:    RateLimit{Events: 60, Per: 10 * time.Second},
+		RateMessages:  RateLimit{Events: 20, Per: 10 * time.Second},
+		RateNickname:  RateLimit{Events: 3, Per: time.Minute},
+		RateFileShare: RateLimit{Events: 10, Per: time.Minute},
+	}
+}
+
+// bindFlags registers one flag per config field, writing straight into cfg.
+func bindFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.Port, "port", cfg.Port, "Port for the server to listen on")
+	fs.StringVar(&cfg.UploadsDir, "uploads-dir", cfg.UploadsDir, "Directory where uploaded files are stored")
+	fs.StringVar(&cfg.StaticDir, "static-dir", cfg.StaticDir, "Directory holding index.html and the client scripts")
+	fs.StringVar(&cfg.History, "history", cfg.History, "Message history backend: none, memory or file")
+	fs.IntVar(&cfg.HistorySize, "history-size", cfg.HistorySize, "Number of messages the history backend keeps in memory")
+	fs.StringVar(&cfg.HistoryFile, "history-file", cfg.HistoryFile, "Append-only log used by the file history backend")
+	fs.BoolVar(&cfg.Persist, "persist", cfg.Persist, "Keep uploaded files and sessions across restarts instead of wiping them on shutdown")
+	fs.StringVar(&cfg.StateFile, "state-file", cfg.StateFile, "Snapshot file used by -persist")
+	fs.Var(&cfg.SessionTimeout, "session-timeout", "How long a disconnected session is kept before it is removed")
+	fs.Var(&cfg.WriteWait, "write-wait", "Time allowed to write a message to a websocket")
+	fs.IntVar(&cfg.SendBuffer, "send-buffer", cfg.SendBuffer, "Outgoing messages buffered per client before it is considered stuck")
+	fs.Var(&cfg.ReadTimeout, "read-timeout", "HTTP server read timeout")
+	fs.Var(&cfg.WriteTimeout, "write-timeout", "HTTP server write timeout")
+	fs.Var(&cfg.ShutdownTimeout, "shutdown-timeout", "How long shutdown waits for requests and clients to finish")
+	fs.Var(&cfg.PingInterval, "ping-interval", "How often the server pings each websocket client")
+	fs.Var(&cfg.PongTimeout, "pong-timeout", "How long a websocket client may stay silent before it is considered gone")
+	fs.Int64Var(&cfg.MaxFileSize, "max-file-size", cfg.MaxFileSize, "Maximum size of a single uploaded file in bytes (0 = unlimited)")
+	fs.IntVar(&cfg.MaxUploadsPerSession, "max-uploads-per-session", cfg.MaxUploadsPerSession, "Maximum unfinished uploads per session (0 = unlimited)")
+	fs.Int64Var(&cfg.SessionQuota, "session-quota", cfg.SessionQuota, "Total bytes a session may upload (0 = unlimited)")
+	fs.Int64Var(&cfg.DiskBudget, "disk-budget", cfg.DiskBudget, "Total bytes the uploads directory may hold (0 = unlimited)")
+	fs.Var(&cfg.UploadTTL, "upload-ttl", "How long an unfinished upload may sit idle before its .part file is deleted")
+	fs.Var(&cfg.OrphanTTL, "orphan-ttl", "How long a finished upload may wait to be shared before it is deleted")
+	fs.Var(&cfg.JanitorInterval, "janitor-interval", "How often abandoned and orphaned uploads are looked for")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert, "PEM certificate (chain) for HTTPS; requires -tls-key")
+	fs.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "PEM private key matching -tls-cert")
+	fs.BoolVar(&cfg.TLSSelfSigned, "tls-self-signed", cfg.TLSSelfSigned, "Serve HTTPS with a self-signed CA and server certificate generated in -tls-dir")
+	fs.StringVar(&cfg.TLSDir, "tls-dir", cfg.TLSDir, "Directory where the self-signed CA and server certificate are kept")
+	fs.StringVar(&cfg.TLSHosts, "tls-hosts", cfg.TLSHosts, "Extra comma-separated host names or IPs for the self-signed server certificate")
+	fs.StringVar(&cfg.AdminPassword, "admin-password", cfg.AdminPassword, "Password for the /admin API (empty disables it); prefer CHATROOM_ADMIN_PASSWORD")
+	fs.StringVar(&cfg.ModeratorSecret, "moderator-secret", cfg.ModeratorSecret, "Secret that grants moderator rights via a moderatorLogin message (empty disables it)")
+	fs.StringVar(&cfg.ModeratorKeys, "moderator-keys", cfg.ModeratorKeys, "Comma-separated SHA-256 public key fingerprints that are moderators on registration")
+	fs.Int64Var(&cfg.MaxFrameSize, "max-frame-size", cfg.MaxFrameSize, "Largest websocket frame a client may send, in bytes")
+	fs.Var(&cfg.RateFrames, "rate-frames", "Websocket frames a client may send, as N/interval (0 = unlimited)")
+	fs.Var(&cfg.RateMessages, "rate-messages", "Private and group messages a client may send, as N/interval (0 = unlimited)")
+	fs.Var(&cfg.RateNickname, "rate-nickname", "Nickname changes a client may make, as N/interval (0 = unlimited)")
+	fs.Var(&cfg.RateFileShare, "rate-file-share", "File shares a client may send, as N/interval (0 = unlimited)")
+}
+
+// envName maps a flag name to its environment variable, e.g. max-file-size -> CHATROOM_MAX_FILE_SIZE.
+func envName(flagName string) string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig builds the effective configuration from defaults, the config
+// file, CHATROOM_* environment variables and command-line flags, in that order.
+func loadConfig(fs *flag.FlagSet, args []string) (Config, error) {
+	cfg := defaultConfig()
+	bindFlags(fs, &cfg)
+	configPath := fs.String("config", os.Getenv(envName("config")), "Path to a JSON config file")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	// 先记下命令行显式给出的值，再从默认值开始逐层叠加，最后重新应用它们
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = f.Value.String() })
+	cfg = defaultConfig()
+
+	if *configPath != "" {
+		if err := readConfigFile(*configPath, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", envName(f.Name), err))
+			}
+		}
+	})
+	for name, v := range explicit {
+		if name != "config" {
+			fs.Set(name, v)
+		}
+	}
+	if len(errs) > 0 {
+		return cfg, errors.Join(errs...)
+	}
+	return cfg, cfg.validate()
+}
+
+func readConfigFile(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+// validate rejects values the server cannot run with.
+func (c Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(c.Port)
+	check(err == nil && port > 0 && port <= 65535, "port %q must be a number between 1 and 65535", c.Port)
+	check(c.UploadsDir != "", "uploadsDir must not be empty")
+	if fi, err := os.Stat(filepath.Join(c.StaticDir, "index.html")); err != nil || fi.IsDir() {
+		errs = append(errs, fmt.Errorf("staticDir %q does not contain index.html", c.StaticDir))
+	}
+	switch c.History {
+	case "none", "memory", "file":
+	default:
+		errs = append(errs, fmt.Errorf("history must be none, memory or file, not %q", c.History))
+	}
+	check(c.History == "none" || c.HistorySize > 0, "historySize must be positive")
+	check(c.History != "file" || c.HistoryFile != "", "historyFile must not be empty")
+	check(!c.Persist || c.StateFile != "", "stateFile must not be empty when persist is enabled")
+	check(c.SessionTimeout > 0, "sessionTimeout must be positive")
+	check(c.WriteWait > 0, "writeWait must be positive")
+	check(c.SendBuffer > 0, "sendBuffer must be positive")
+	check(c.ReadTimeout >= 0 && c.WriteTimeout >= 0, "readTimeout and writeTimeout must not be negative")
+	check(c.ShutdownTimeout > 0, "shutdownTimeout must be positive")
+	check(c.PingInterval > 0 && c.PingInterval < c.PongTimeout, "pingInterval must be positive and shorter than pongTimeout")
+	check(c.MaxFileSize >= 0 && c.SessionQuota >= 0 && c.DiskBudget >= 0 && c.MaxUploadsPerSession >= 0,
+		"upload limits must not be negative")
+	check(c.UploadTTL > 0 && c.OrphanTTL > 0, "uploadTTL and orphanTTL must be positive")
+	check(c.JanitorInterval > 0, "janitorInterval must be positive")
+	check(c.MaxFrameSize >= 4096, "maxFrameSize must be at least 4096 bytes")
+	check((c.TLSCert == "") == (c.TLSKey == ""), "tlsCert and tlsKey must be given together")
+	check(c.TLSCert == "" || !c.TLSSelfSigned, "tlsSelfSigned cannot be combined with tlsCert/tlsKey")
+	check(!c.TLSSelfSigned || c.TLSDir != "", "tlsDir must not be empty when tlsSelfSigned is enabled")
+	return errors.Join(errs...)
+}
+
+// settings are the tunables a Hub reads at run time, derived from a Config.
+// Each Hub has its own copy, so servers with different configurations can run side by side.
+type settings struct {
+	sessionTimeout     time.Duration
+	mailboxMaxAge      time.Duration // Queued private messages older than this are dropped
+	writeWait          time.Duration // Write timeout for websocket frames
+	sendBufferSize     int           // Capacity of each client's send channel
+	shutdownTimeout    time.Duration // How long shutdown waits for requests and clients
+	pingInterval       time.Duration // websocket 心跳：每隔 pingInterval 发送 ping，pongTimeout 内没有回应就断开
+	pongTimeout        time.Duration
+	uploadLimits       UploadLimits
+	abandonedUploadTTL time.Duration // .part 文件在最后一次写入后保留的时间
+	orphanedFileTTL    time.Duration // 已完成但未分享的文件保留的时间
+	janitorInterval    time.Duration // How often the upload janitor runs
+	adminPassword      string        // Empty disables /admin
+	maxFrameSize       int64
+	rateLimits         map[string]RateLimit
+	moderatorSecret    string
+	moderatorKeys      map[string]bool // Public key fingerprints granted moderator on registration
+}
+
+func newSettings(c Config) settings {
+	s := settings{
+		sessionTimeout:  time.Duration(c.SessionTimeout),
+		mailboxMaxAge:   time.Duration(c.SessionTimeout),
+		writeWait:       time.Duration(c.WriteWait),
+		sendBufferSize:  c.SendBuffer,
+		shutdownTimeout: time.Duration(c.ShutdownTimeout),
+		pingInterval:    time.Duration(c.PingInterval),
+		pongTimeout:     time.Duration(c.PongTimeout),
+		uploadLimits: UploadLimits{
+			MaxFileSize:          c.MaxFileSize,
+			MaxConcurrentUploads: c.MaxUploadsPerSession,
+			SessionQuota:         c.SessionQuota,
+			DiskBudget:           c.DiskBudget,
+		},
+		abandonedUploadTTL: time.Duration(c.UploadTTL),
+		orphanedFileTTL:    time.Duration(c.OrphanTTL),
+		janitorInterval:    time.Duration(c.JanitorInterval),
+		adminPassword:      c.AdminPassword,
+		maxFrameSize:       c.MaxFrameSize,
+		rateLimits: map[string]RateLimit{
+			rateClassFrames:    c.RateFrames,
+			rateClassMessages:  c.RateMessages,
+			rateClassNickname:  c.RateNickname,
+			rateClassFileShare: c.RateFileShare,
+		},
+		moderatorSecret: c.ModeratorSecret,
+		moderatorKeys:   make(map[string]bool),
+	}
+	for _, fp := range strings.Split(c.ModeratorKeys, ",") {
+		if fp = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fp), ":", "")); fp != "" {
+			s.moderatorKeys[fp] = true
+		}
+	}
+	return s
+}
+
+func logConfig(c Config) {
+	if c.AdminPassword != "" {
+		c.AdminPassword = "********"
+	}
+	if c.ModeratorSecret != "" {
+		c.ModeratorSecret = "********"
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return
+	}
+	log.Printf("Effective configuration:\n%s", data)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// 编辑与撤回：发送者可以修改或撤回自己发出的 privateMessage / groupMessage。
+// 服务器按原消息的路由把新的加密内容或撤回标记转发给原来的接收者，并同步修改历史记录；
+// 被撤回的消息在历史中只留下 ID、发送者和时间戳。只有原发送者（按 ClientID 校验）可以操作。
+
+// messageChange is relayed as messageEdited or messageDeleted.
+type messageChange struct {
+	Type     string `json:"type"`
+	ID       int64  `json:"id"`
+	From     string `json:"from"`
+	To       string `json:"to,omitempty"`
+	Room     string `json:"room,omitempty"`
+	Data     string `json:"data,omitempty"`
+	EditedAt int64  `json:"editedAt"`
+}
+
+// storedMessage returns the history entry of a message, or nil when history
+// is disabled or no longer holds it.
+func (h *Hub) storedMessage(id int64) *HistoryEntry {
+	if h.history == nil {
+		return nil
+	}
+	entry, err := h.history.Get(id)
+	if err != nil {
+		log.Printf("History lookup of message %d failed: %v", id, err)
+		return nil
+	}
+	return entry
+}
+
+// lookupMessage finds the route of a relayed message, first among recent
+// messages and then in stored history.
+func (h *Hub) lookupMessage(id int64) *messageRoute {
+	h.messagesMu.Lock()
+	route, ok := h.recentMessages[id]
+	h.messagesMu.Unlock()
+	if ok {
+		return route
+	}
+	entry := h.storedMessage(id)
+	if entry == nil || entry.Message.Deleted {
+		return nil
+	}
+	return &messageRoute{
+		ID: id, Type: entry.Message.Type, SenderID: entry.FromID,
+		Kind: entry.Kind, Room: entry.Room, ToID: entry.ToID, ThreadID: entry.Message.ThreadID,
+	}
+}
+
+// handleMessageChange 处理 editMessage 和 deleteMessage
+func (h *Hub) handleMessageChange(client *Client, msg Message) {
+	deleting := msg.Type == "deleteMessage"
+	if msg.ID <= 0 || (!deleting && msg.Data == "") {
+		rejectOperation(client, msg, errInvalidRequest, "缺少消息 ID 或内容", nil)
+		return
+	}
+	route := h.lookupMessage(msg.ID)
+	if route == nil || (route.Type != "privateMessage" && route.Type != "groupMessage") {
+		rejectOperation(client, msg, errNotFound, "消息不存在或已无法修改", nil)
+		return
+	}
+	if route.SenderID != client.clientID {
+		rejectOperation(client, msg, errForbidden, "只能修改自己发送的消息", nil)
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	change := messageChange{Type: "messageEdited", ID: msg.ID, Room: route.Room, Data: msg.Data, EditedAt: now}
+	if deleting {
+		change.Type, change.Data = "messageDeleted", ""
+	}
+
+	h.mutex.Lock()
+	if !deleting && h.isMutedLocked(client.clientID) {
+		h.mutex.Unlock()
+		rejectOperation(client, msg, errForbidden, "你已被禁言", nil)
+		return
+	}
+	change.From = client.nickname
+	var recipients []*Client
+	switch route.Kind {
+	case historyConvGroup:
+		for c := range h.clients {
+			if c != client {
+				recipients = append(recipients, c)
+			}
+		}
+	case historyConvRoom:
+		for _, c := range h.roomClientsLocked(route.Room) {
+			if c != client {
+				recipients = append(recipients, c)
+			}
+		}
+	case historyConvPrivate:
+		if session, ok := h.sessions[route.ToID]; ok {
+			change.To = session.Nickname
+			if session.Client != nil {
+				recipients = []*Client{session.Client}
+			} else {
+				amendMailboxLocked(session, msg.ID, change)
+			}
+		}
+	}
+	h.mutex.Unlock()
+	if deleting {
+		h.messagesMu.Lock()
+		delete(h.recentMessages, msg.ID)
+		h.messagesMu.Unlock()
+	}
+
+	msgBytes, err := json.Marshal(change)
+	if err != nil {
+		return
+	}
+	for _, recipient := range recipients {
+		sendMessageToClient(recipient, msgBytes)
+	}
+	// 发送者收到同一事件作为确认
+	sendMessageToClient(client, msgBytes)
+	h.metrics.countRelayed(change.Type)
+
+	if entry := h.storedMessage(msg.ID); entry != nil {
+		if deleting {
+			entry.Message.Data, entry.Message.Deleted = "", true
+		} else {
+			entry.Message.Data = msg.Data
+		}
+		entry.Message.Edited = now
+		if err := h.history.Update(entry); err != nil {
+			log.Printf("Failed to update history for message %d: %v", msg.ID, err)
+		}
+	}
+	if deleting {
+		h.noteThreadReplyDeleted(route)
+	}
+}
+
+// amendMailboxLocked applies a change to a private message still waiting in
+// an offline recipient's mailbox: an edit rewrites the queued payload and a
+// deletion drops it. Caller must hold mutex.
+func amendMailboxLocked(session *Session, id int64, change messageChange) {
+	for i, m := range session.Mailbox {
+		if m.ID != id {
+			continue
+		}
+		if change.Type == "messageDeleted" {
+			session.Mailbox = append(session.Mailbox[:i], session.Mailbox[i+1:]...)
+			return
+		}
+		var queued Message
+		if err := json.Unmarshal(m.Payload, &queued); err != nil {
+			return
+		}
+		queued.Data, queued.Edited = change.Data, change.EditedAt
+		if payload, err := json.Marshal(queued); err == nil {
+			session.Mailbox[i].Payload = payload
+		}
+		return
+	}
+}
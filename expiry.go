@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// 文件过期与撤回：发送者可在 fileShare 时设置有效期或下载次数上限，
+// 也可以随时撤回。过期/撤回后磁盘上的文件被删除，但登记项保留一段时间，
+// 以便下载接口返回 410 Gone 而不是 404。
+// 达到下载次数上限后，已经开始的下载仍可在 fileResumeWindow 内用 Range 请求续传。
+const (
+	fileTombstoneTTL = 24 * time.Hour
+	fileResumeWindow = 10 * time.Minute
+)
+
+// setFileExpiryLocked applies the sender's expiry settings to a file. Only the
+// file's owner may change them. Caller must hold filesMu.
+func setFileExpiryLocked(info *FileInfo, clientID string, expiresIn int64, maxDownloads int) {
+	if info.Owner != clientID || (expiresIn <= 0 && maxDownloads <= 0) {
+		return
+	}
+	if expiresIn > 0 {
+		info.ExpiresAt = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	}
+	if maxDownloads > 0 {
+		info.MaxDownloads = maxDownloads
+	}
+}
+
+// fileExpiredLocked reports whether the file has run out of time, or ran out
+// of downloads longer than fileResumeWindow ago. Caller must hold filesMu.
+func fileExpiredLocked(info *FileInfo, now time.Time) bool {
+	if info.Gone {
+		return true
+	}
+	if !info.ExpiresAt.IsZero() && now.After(info.ExpiresAt) {
+		return true
+	}
+	return downloadsExhaustedLocked(info) && now.Sub(info.ExhaustedAt) > fileResumeWindow
+}
+
+// downloadsExhaustedLocked reports whether no new requester may start a
+// download. Caller must hold filesMu.
+func downloadsExhaustedLocked(info *FileInfo) bool {
+	return info.MaxDownloads > 0 && info.Downloads >= info.MaxDownloads
+}
+
+// countDownloadLocked counts the requester's first download of a file.
+// Repeated and resumed downloads by the same requester are free, so an
+// interrupted transfer can continue with a Range request. It returns false
+// if the requester is new and the download limit has been reached.
+// Caller must hold filesMu.
+func countDownloadLocked(info *FileInfo, clientID string, now time.Time) bool {
+	if info.Downloaders[clientID] {
+		return true
+	}
+	if downloadsExhaustedLocked(info) {
+		return false
+	}
+	if info.Downloaders == nil {
+		info.Downloaders = make(map[string]bool)
+	}
+	info.Downloaders[clientID] = true
+	info.Downloads++
+	if downloadsExhaustedLocked(info) {
+		info.ExhaustedAt = now
+	}
+	return true
+}
+
+// retireFileLocked deletes the blob and leaves a tombstone. Caller must hold filesMu.
+func (h *Hub) retireFileLocked(uuid string, info *FileInfo, reason string) {
+	if info.Gone {
+		return
+	}
+	log.Printf("File UUID %s is no longer available (%s). Deleting it from disk.", uuid, reason)
+	if err := h.removeUploadFileLocked(info.Path); err != nil {
+		log.Printf("Failed to delete file %s: %v", info.Path, err)
+	}
+	info.Gone = true
+	info.GoneAt = time.Now()
+	delete(h.uploads, uuid)
+}
+
+// fileRecipientsLocked returns every connected client that can see the file.
+// Caller must hold mutex and filesMu.
+func (h *Hub) fileRecipientsLocked(info *FileInfo) []*Client {
+	seen := make(map[*Client]bool)
+	var recipients []*Client
+	add := func(c *Client) {
+		if c != nil && !seen[c] {
+			seen[c] = true
+			recipients = append(recipients, c)
+		}
+	}
+	online := func(clientID string) *Client {
+		if session, ok := h.sessions[clientID]; ok {
+			return session.Client
+		}
+		return nil
+	}
+	for _, ref := range info.References {
+		add(online(ref.SenderID))
+		switch {
+		case ref.Room != "":
+			for _, c := range h.roomClientsLocked(ref.Room) {
+				add(c)
+			}
+		case ref.Group:
+			for c := range h.clients {
+				add(c)
+			}
+		default:
+			add(online(ref.RecipientID))
+		}
+	}
+	return recipients
+}
+
+func notifyFileGone(recipients []*Client, eventType, uuid, from string) {
+	response := map[string]string{"type": eventType, "uuid": uuid}
+	if from != "" {
+		response["from"] = from
+	}
+	if msgBytes, err := json.Marshal(response); err == nil {
+		for _, c := range recipients {
+			sendMessageToClient(c, msgBytes)
+		}
+	}
+}
+
+// handleRevokeFile 只有原始发送者可以撤回文件
+func (h *Hub) handleRevokeFile(client *Client, msg Message) {
+	uuid := msg.UUID
+	h.mutex.Lock()
+	h.filesMu.Lock()
+	info, ok := h.fileRegistry[uuid]
+	if !ok || info.Gone || info.Owner != client.clientID {
+		h.filesMu.Unlock()
+		h.mutex.Unlock()
+		code := errForbidden
+		if !ok || info.Gone {
+			code = errNotFound
+		}
+		rejectOperation(client, msg, code, "文件不存在或你无权撤回", map[string]string{"type": "fileError", "uuid": uuid})
+		return
+	}
+	h.retireFileLocked(uuid, info, "revoked by "+client.nickname)
+	recipients := h.fileRecipientsLocked(info)
+	nickname := client.nickname
+	h.filesMu.Unlock()
+	h.mutex.Unlock()
+
+	notifyFileGone(recipients, "fileRevoked", uuid, nickname)
+}
+
+// expireFiles retires files past their deadline and forgets old tombstones.
+func (h *Hub) expireFiles(now time.Time) {
+	type expired struct {
+		uuid       string
+		recipients []*Client
+	}
+	var notify []expired
+
+	h.mutex.Lock()
+	h.filesMu.Lock()
+	for uuid, info := range h.fileRegistry {
+		if info.Gone {
+			if now.Sub(info.GoneAt) > fileTombstoneTTL {
+				delete(h.fileRegistry, uuid)
+			}
+			continue
+		}
+		if fileExpiredLocked(info, now) {
+			h.retireFileLocked(uuid, info, "expired")
+			notify = append(notify, expired{uuid: uuid, recipients: h.fileRecipientsLocked(info)})
+		}
+	}
+	h.filesMu.Unlock()
+	h.mutex.Unlock()
+
+	for _, e := range notify {
+		notifyFileGone(e.recipients, "fileExpired", e.uuid, "")
+	}
+}
@@ -2,4 +2,4 @@ module chatroom
 
 go 1.25.1
 
-require github.com/gorilla/websocket v1.5.3 // indirect
+require github.com/gorilla/websocket v1.5.3
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 历史记录只保存已加密的消息信封，服务器本身仍无法读取内容
+const (
+	historyConvGroup   = "group"
+	historyConvRoom    = "room"
+	historyConvPrivate = "private"
+
+	historyDefaultLimit = 50
+	historyMaxLimit     = 200
+	historyReplayLimit  = 50
+)
+
+// HistoryEntry is one relayed message envelope together with the routing
+// information needed to decide who may read it back.
+type HistoryEntry struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`           // historyConvGroup, historyConvRoom or historyConvPrivate
+	Room    string    `json:"room,omitempty"` // For historyConvRoom
+	FromID  string    `json:"fromID"`         // Sender's ClientID
+	ToID    string    `json:"toID,omitempty"` // Recipient's ClientID for historyConvPrivate
+	Message Message   `json:"message"`
+}
+
+// HistoryQuery selects a page of entries by message ID. After takes
+// precedence over Before; a zero Before means "latest".
+type HistoryQuery struct {
+	Before  int64
+	After   int64
+	Limit   int
+	Matches func(*HistoryEntry) bool
+}
+
+// HistoryStore is the pluggable backend behind message history.
+type HistoryStore interface {
+	// Append stores an entry. Entries may arrive slightly out of message ID
+	// order, since IDs are assigned before the message is relayed; stores
+	// keep them sorted by ID.
+	Append(entry *HistoryEntry) error
+	// Update replaces the stored entry with the same message ID, e.g. after
+	// an edit or deletion. Entries no longer stored are ignored.
+	Update(entry *HistoryEntry) error
+	// Get returns the stored entry with the given message ID, or nil.
+	Get(id int64) (*HistoryEntry, error)
+	// Query returns matching entries in ascending order and whether more exist beyond the page.
+	Query(q HistoryQuery) ([]HistoryEntry, bool, error)
+	// LastID returns the highest stored message ID, used to continue numbering after a restart.
+	LastID() int64
+	Close() error
+}
+
+func newHistoryStore(kind string, size int, path string) (HistoryStore, error) {
+	switch kind {
+	case "", "none":
+		return nil, nil
+	case "memory":
+		return NewMemoryHistory(size), nil
+	case "file":
+		return OpenFileHistory(path, size)
+	default:
+		return nil, fmt.Errorf("unknown history backend %q", kind)
+	}
+}
+
+// queryEntries 在按消息 ID 升序排列的 n 条记录上执行分页查询，供各实现复用。
+// idAt 返回第 i 条的 ID，entryAt 在需要时才加载整条记录。
+func queryEntries(n int, idAt func(int) int64, entryAt func(int) (*HistoryEntry, error), q HistoryQuery) ([]HistoryEntry, bool, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = historyDefaultLimit
+	}
+	if limit > historyMaxLimit {
+		limit = historyMaxLimit
+	}
+
+	result := []HistoryEntry{}
+	if q.After > 0 {
+		for i := sort.Search(n, func(i int) bool { return idAt(i) > q.After }); i < n; i++ {
+			e, err := entryAt(i)
+			if err != nil {
+				return nil, false, err
+			}
+			if q.Matches != nil && !q.Matches(e) {
+				continue
+			}
+			if len(result) == limit {
+				return result, true, nil
+			}
+			result = append(result, *e)
+		}
+		return result, false, nil
+	}
+
+	end := n
+	if q.Before > 0 {
+		end = sort.Search(n, func(i int) bool { return idAt(i) >= q.Before })
+	}
+	for i := end - 1; i >= 0; i-- {
+		e, err := entryAt(i)
+		if err != nil {
+			return nil, false, err
+		}
+		if q.Matches != nil && !q.Matches(e) {
+			continue
+		}
+		if len(result) == limit {
+			reverseEntries(result)
+			return result, true, nil
+		}
+		result = append(result, *e)
+	}
+	reverseEntries(result)
+	return result, false, nil
+}
+
+func reverseEntries(entries []HistoryEntry) {
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+}
+
+// MemoryHistory keeps the most recent entries in a fixed-size ring buffer.
+type MemoryHistory struct {
+	mu      sync.Mutex
+	entries []HistoryEntry
+	start   int // index of the oldest entry once the buffer is full
+	lastID  int64
+}
+
+func NewMemoryHistory(capacity int) *MemoryHistory {
+	if capacity <= 0 {
+		capacity = 1000
+	}
+	return &MemoryHistory{entries: make([]HistoryEntry, 0, capacity)}
+}
+
+// at maps the k-th oldest entry to its index in the ring.
+func (h *MemoryHistory) at(k int) int {
+	return (h.start + k) % len(h.entries)
+}
+
+// find returns the ring index of the entry with the given ID, or -1.
+func (h *MemoryHistory) find(id int64) int {
+	n := len(h.entries)
+	k := sort.Search(n, func(k int) bool { return h.entries[h.at(k)].Message.ID >= id })
+	if k < n && h.entries[h.at(k)].Message.ID == id {
+		return h.at(k)
+	}
+	return -1
+}
+
+func (h *MemoryHistory) Append(entry *HistoryEntry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastID = max(h.lastID, entry.Message.ID)
+	k := len(h.entries)
+	if k < cap(h.entries) {
+		h.entries = append(h.entries, *entry)
+	} else {
+		h.entries[h.start] = *entry
+		h.start = (h.start + 1) % len(h.entries)
+		k--
+	}
+	// 迟到的消息向前移动到按 ID 排序的位置
+	for ; k > 0 && h.entries[h.at(k-1)].Message.ID > entry.Message.ID; k-- {
+		h.entries[h.at(k-1)], h.entries[h.at(k)] = h.entries[h.at(k)], h.entries[h.at(k-1)]
+	}
+	return nil
+}
+
+func (h *MemoryHistory) Update(entry *HistoryEntry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i := h.find(entry.Message.ID); i >= 0 {
+		h.entries[i] = *entry
+	}
+	return nil
+}
+
+func (h *MemoryHistory) Get(id int64) (*HistoryEntry, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i := h.find(id); i >= 0 {
+		entry := h.entries[i]
+		return &entry, nil
+	}
+	return nil, nil
+}
+
+func (h *MemoryHistory) Query(q HistoryQuery) ([]HistoryEntry, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return queryEntries(len(h.entries),
+		func(k int) int64 { return h.entries[h.at(k)].Message.ID },
+		func(k int) (*HistoryEntry, error) { return &h.entries[h.at(k)], nil },
+		q)
+}
+
+func (h *MemoryHistory) LastID() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastID
+}
+
+func (h *MemoryHistory) Close() error { return nil }
+
+// recordLoc locates the latest record of one message in the history log.
+type recordLoc struct {
+	ID     int64
+	Offset int64
+	Length int
+}
+
+// FileHistory appends every entry as a JSON line to a log file. Updates are
+// appended too, and a later record for an ID replaces the earlier one. Only
+// an index of the log and the newest entries are kept in memory; older pages
+// are read back from disk. The log is compacted to one record per message
+// each time it is opened.
+type FileHistory struct {
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	index  []recordLoc // sorted by ID
+	recent *MemoryHistory
+	lastID int64
+}
+
+func OpenFileHistory(path string, capacity int) (*FileHistory, error) {
+	index, err := compactHistoryLog(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	h := &FileHistory{file: f, size: info.Size(), index: index, recent: NewMemoryHistory(capacity)}
+	for _, loc := range index[max(len(index)-cap(h.recent.entries), 0):] {
+		entry, err := h.readLocked(loc)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		h.recent.Append(entry)
+	}
+	if n := len(index); n > 0 {
+		h.lastID = index[n-1].ID
+	}
+	log.Printf("Loaded %d history record(s) from %s", len(index), path)
+	return h, nil
+}
+
+// compactHistoryLog replays the log at path and, unless it already holds
+// exactly one record per message in ID order, rewrites it that way. It
+// returns the index of the resulting file.
+func compactHistoryLog(path string) ([]recordLoc, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	latest := make(map[int64]recordLoc)
+	reader := bufio.NewReader(f)
+	var offset, lastID int64
+	records, compact := 0, true
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var record struct {
+				Message struct {
+					ID int64 `json:"id"`
+				} `json:"message"`
+			}
+			if jsonErr := json.Unmarshal(line, &record); jsonErr != nil {
+				log.Printf("Skipping corrupt history record in %s: %v", path, jsonErr)
+				compact = false
+			} else {
+				id := record.Message.ID
+				compact = compact && id > lastID && line[len(line)-1] == '\n'
+				lastID = id
+				latest[id] = recordLoc{ID: id, Offset: offset, Length: len(line)}
+				records++
+			}
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading history log: %w", err)
+		}
+	}
+
+	index := make([]recordLoc, 0, len(latest))
+	for _, loc := range latest {
+		index = append(index, loc)
+	}
+	sort.Slice(index, func(i, j int) bool { return index[i].ID < index[j].ID })
+	if compact {
+		return index, nil
+	}
+
+	// 写入临时文件后再替换，中途失败不会损坏原日志
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	offset = 0
+	for i, loc := range index {
+		line := make([]byte, loc.Length)
+		if _, err := f.ReadAt(line, loc.Offset); err != nil {
+			tmp.Close()
+			return nil, fmt.Errorf("reading history log: %w", err)
+		}
+		line = append(bytes.TrimRight(line, "\n"), '\n')
+		if _, err := w.Write(line); err != nil {
+			tmp.Close()
+			return nil, err
+		}
+		index[i].Offset, index[i].Length = offset, len(line)
+		offset += int64(len(line))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	log.Printf("Compacted history log %s: %d record(s) down to %d", path, records, len(index))
+	return index, nil
+}
+
+// readLocked loads one record from the log. Caller must hold mu.
+func (h *FileHistory) readLocked(loc recordLoc) (*HistoryEntry, error) {
+	line := make([]byte, loc.Length)
+	if _, err := h.file.ReadAt(line, loc.Offset); err != nil {
+		return nil, fmt.Errorf("reading history log: %w", err)
+	}
+	var entry HistoryEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return nil, fmt.Errorf("decoding history record %d: %w", loc.ID, err)
+	}
+	return &entry, nil
+}
+
+// writeLocked appends a record to the log and returns its location.
+// Caller must hold mu.
+func (h *FileHistory) writeLocked(entry *HistoryEntry) (recordLoc, error) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return recordLoc{}, err
+	}
+	line = append(line, '\n')
+	if _, err := h.file.Write(line); err != nil {
+		return recordLoc{}, err
+	}
+	loc := recordLoc{ID: entry.Message.ID, Offset: h.size, Length: len(line)}
+	h.size += int64(len(line))
+	return loc, nil
+}
+
+// findLocked returns the position of id in the index, and whether it is there.
+// Caller must hold mu.
+func (h *FileHistory) findLocked(id int64) (int, bool) {
+	i := sort.Search(len(h.index), func(i int) bool { return h.index[i].ID >= id })
+	return i, i < len(h.index) && h.index[i].ID == id
+}
+
+func (h *FileHistory) Append(entry *HistoryEntry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	loc, err := h.writeLocked(entry)
+	if err != nil {
+		return err
+	}
+	if i, ok := h.findLocked(loc.ID); ok {
+		h.index[i] = loc
+	} else {
+		h.index = slices.Insert(h.index, i, loc)
+	}
+	h.lastID = max(h.lastID, loc.ID)
+	return h.recent.Append(entry)
+}
+
+func (h *FileHistory) Update(entry *HistoryEntry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i, ok := h.findLocked(entry.Message.ID)
+	if !ok {
+		return nil
+	}
+	loc, err := h.writeLocked(entry)
+	if err != nil {
+		return err
+	}
+	h.index[i] = loc
+	return h.recent.Update(entry)
+}
+
+// getLocked returns the i-th indexed entry, from memory if it is still
+// cached. Caller must hold mu.
+func (h *FileHistory) getLocked(i int) (*HistoryEntry, error) {
+	if entry, _ := h.recent.Get(h.index[i].ID); entry != nil {
+		return entry, nil
+	}
+	return h.readLocked(h.index[i])
+}
+
+func (h *FileHistory) Get(id int64) (*HistoryEntry, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i, ok := h.findLocked(id)
+	if !ok {
+		return nil, nil
+	}
+	return h.getLocked(i)
+}
+
+func (h *FileHistory) Query(q HistoryQuery) ([]HistoryEntry, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return queryEntries(len(h.index),
+		func(i int) int64 { return h.index[i].ID },
+		func(i int) (*HistoryEntry, error) {
+			return h.getLocked(i)
+		},
+		q)
+}
+
+func (h *FileHistory) LastID() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastID
+}
+
+func (h *FileHistory) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.file.Close()
+}
+
+// recordHistory stores a relayed message if history is enabled.
+func (h *Hub) recordHistory(kind, room, fromID, toID string, msg Message) {
+	if h.history == nil {
+		return
+	}
+	entry := &HistoryEntry{Time: time.UnixMilli(msg.Timestamp), Kind: kind, Room: room, FromID: fromID, ToID: toID, Message: msg}
+	if err := h.history.Append(entry); err != nil {
+		log.Printf("Failed to record history: %v", err)
+	}
+}
+
+func sendHistory(client *Client, to, room string, entries []HistoryEntry, more, replay bool) {
+	items := make([]Message, 0, len(entries))
+	for _, e := range entries {
+		items = append(items, e.Message)
+	}
+	response := map[string]interface{}{"type": "history", "messages": items, "hasMore": more}
+	if to != "" {
+		response["to"] = to
+	}
+	if room != "" {
+		response["room"] = room
+	}
+	if replay {
+		response["replay"] = true
+	}
+	if msgBytes, err := json.Marshal(response); err == nil {
+		sendMessageToClient(client, msgBytes)
+	}
+}
+
+// handleHistoryRequest 按会话（群聊、房间或私聊对象）分页返回历史记录
+func (h *Hub) handleHistoryRequest(client *Client, msg Message) {
+	if h.history == nil {
+		rejectOperation(client, msg, errUnavailable, "服务器未启用历史记录", map[string]string{"type": "historyError"})
+		return
+	}
+
+	myID := client.clientID
+	var matches func(*HistoryEntry) bool
+	switch {
+	case msg.Room != "":
+		if !h.isRoomMember(msg.Room, client) {
+			sendRoomError(client, msg, errForbidden, "你不在该房间中")
+			return
+		}
+		matches = func(e *HistoryEntry) bool { return e.Kind == historyConvRoom && e.Room == msg.Room }
+	case msg.To == "" || msg.To == groupRecipient:
+		matches = func(e *HistoryEntry) bool { return e.Kind == historyConvGroup }
+	default:
+		h.mutex.Lock()
+		peerID := h.clientIDOfLocked(msg.To)
+		h.mutex.Unlock()
+		if peerID == "" {
+			sendHistory(client, msg.To, "", nil, false, false)
+			return
+		}
+		matches = func(e *HistoryEntry) bool {
+			return e.Kind == historyConvPrivate &&
+				((e.FromID == myID && e.ToID == peerID) || (e.FromID == peerID && e.ToID == myID))
+		}
+	}
+
+	entries, more, err := h.history.Query(HistoryQuery{Before: msg.Before, After: msg.After, Limit: msg.Limit, Matches: matches})
+	if err != nil {
+		log.Printf("History query failed for %s: %v", client.nickname, err)
+		rejectOperation(client, msg, errInternal, "读取历史记录失败", map[string]string{"type": "historyError"})
+		return
+	}
+	sendHistory(client, msg.To, msg.Room, entries, more, false)
+}
+
+// visibleTo returns a filter for the entries the client may read: the group
+// chat, rooms it is currently in and its own private conversations.
+func (h *Hub) visibleTo(client *Client) func(*HistoryEntry) bool {
+	h.mutex.Lock()
+	myID := client.clientID
+	myRooms := make(map[string]bool)
+	for _, name := range h.roomsOfLocked(myID) {
+		myRooms[name] = true
+	}
+	h.mutex.Unlock()
+
+	return func(e *HistoryEntry) bool {
+		switch e.Kind {
+		case historyConvGroup:
+			return true
+		case historyConvRoom:
+			return myRooms[e.Room]
+		case historyConvPrivate:
+			return e.FromID == myID || e.ToID == myID
+		}
+		return false
+	}
+}
+
+// replayHistory 在加入时推送该客户端可见的最近消息
+func (h *Hub) replayHistory(client *Client) {
+	if h.history == nil {
+		return
+	}
+	entries, more, err := h.history.Query(HistoryQuery{Limit: historyReplayLimit, Matches: h.visibleTo(client)})
+	if err != nil {
+		log.Printf("History replay failed for %s: %v", client.nickname, err)
+		return
+	}
+	if len(entries) > 0 {
+		sendHistory(client, "", "", entries, more, true)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hub 持有一个聊天服务器实例的全部状态：连接、会话、房间、文件登记、封禁等。
+// 状态按领域分成三把锁：mutex 保护在线状态（连接、会话、房间、封禁），
+// filesMu 保护上传与文件登记，messagesMu 保护消息路由与话题统计。
+// 需要同时持有时总是先取 mutex；filesMu 与 messagesMu 不会同时持有。
+// 向客户端发送消息前必须先释放所有锁，因为发送可能触发断线清理。
+// 同一进程中可以创建多个互不影响的 Hub，便于测试。
+type Hub struct {
+	settings // Immutable after newHub
+
+	mutex sync.Mutex
+
+	clients       map[*Client]bool
+	nicknames     map[string]*Client
+	sessions      map[string]*Session
+	sessionTokens map[string]string // token -> ClientID
+	rooms         map[string]*Room
+	bans          map[string]*Ban      // kind + ":" + value -> ban
+	mutes         map[string]time.Time // ClientID -> muted until (zero = until unmuted)
+
+	filesMu       sync.Mutex
+	fileRegistry  map[string]*FileInfo
+	uploads       map[string]*Upload
+	uploadedBytes map[string]int64 // ClientID -> bytes uploaded, counted against the session quota
+	diskUsage     int64            // Bytes currently stored or reserved in the uploads directory
+	janitorStats  JanitorStats
+
+	messagesMu     sync.Mutex
+	recentMessages map[int64]*messageRoute
+	recentOrder    []int64
+	threads        map[int64]*threadStats // Root message ID -> reply count, forgotten with the root's route
+
+	uploadsDir    string       // Immutable after newHub
+	history       HistoryStore // nil when history is disabled; immutable after newHub
+	metrics       *serverMetrics
+	startTime     time.Time
+	lastMessageID int64 // accessed atomically
+	shuttingDown  int32 // Set to 1 once shutdown begins, accessed atomically
+	serverReady   int32 // Set to 1 once startup has finished, accessed atomically
+
+	stop     chan struct{} // Closed by Close to end the background tasks
+	stopOnce sync.Once
+}
+
+// newHub creates an empty hub configured by cfg. history may be nil.
+func newHub(cfg Config, history HistoryStore) *Hub {
+	h := &Hub{
+		settings:       newSettings(cfg),
+		clients:        make(map[*Client]bool),
+		nicknames:      make(map[string]*Client),
+		sessions:       make(map[string]*Session),
+		sessionTokens:  make(map[string]string),
+		fileRegistry:   make(map[string]*FileInfo),
+		uploads:        make(map[string]*Upload),
+		uploadedBytes:  make(map[string]int64),
+		rooms:          make(map[string]*Room),
+		bans:           make(map[string]*Ban),
+		mutes:          make(map[string]time.Time),
+		recentMessages: make(map[int64]*messageRoute),
+		recentOrder:    make([]int64, 0, recentMessageLimit),
+		threads:        make(map[int64]*threadStats),
+		uploadsDir:     cfg.UploadsDir,
+		history:        history,
+		metrics:        &serverMetrics{relayed: make(map[string]int64)},
+		startTime:      time.Now(),
+		stop:           make(chan struct{}),
+	}
+	if history != nil {
+		h.seedMessageIDs(history.LastID())
+	}
+	return h
+}
+
+// start prepares the uploads directory and launches the background cleanup tasks.
+func (h *Hub) start() error {
+	if err := os.MkdirAll(h.uploadsDir, 0755); err != nil {
+		return err
+	}
+	h.measureDiskUsage(h.uploadsDir)
+	go h.cleanupInactiveSessions()
+	go h.cleanupAbandonedUploads(h.uploadsDir)
+	atomic.StoreInt32(&h.serverReady, 1)
+	return nil
+}
+
+// Close stops the background tasks and closes the history store. It does not
+// disconnect clients; see drainClients.
+func (h *Hub) Close() {
+	h.stopOnce.Do(func() {
+		close(h.stop)
+		if h.history != nil {
+			if err := h.history.Close(); err != nil {
+				log.Printf("Error closing history: %v", err)
+			}
+		}
+	})
+}
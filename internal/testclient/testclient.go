@@ -0,0 +1,374 @@
+// Package testclient is a scripted chat client for integration tests. It
+// speaks the WebSocket protocol described in PROTOCOL.md, answers the
+// registration challenge with its own RSA key and records every event it
+// receives so tests can wait for and assert on them.
+package testclient
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// keyBits is small to keep tests fast; the server accepts any RSA key size.
+const keyBits = 1024
+
+// DefaultTimeout bounds how long Expect waits for an event.
+var DefaultTimeout = 5 * time.Second
+
+// Identity is a ClientID together with the key pair that owns it. Reusing an
+// Identity across connections resumes the same session.
+type Identity struct {
+	ClientID  string
+	PublicKey string // PEM
+	key       *rsa.PrivateKey
+}
+
+// NewIdentity generates a fresh key pair for clientID.
+func NewIdentity(clientID string) (*Identity, error) {
+	key, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	return &Identity{ClientID: clientID, PublicKey: string(pemKey), key: key}, nil
+}
+
+// Event is one frame received from the server.
+type Event struct {
+	Type   string
+	Raw    json.RawMessage
+	Fields map[string]interface{}
+}
+
+// String returns a string field, or "" if it is missing.
+func (e Event) String(name string) string {
+	s, _ := e.Fields[name].(string)
+	return s
+}
+
+// Int returns a numeric field, or 0 if it is missing.
+func (e Event) Int(name string) int64 {
+	n, _ := e.Fields[name].(float64)
+	return int64(n)
+}
+
+// Bool returns a boolean field, or false if it is missing.
+func (e Event) Bool(name string) bool {
+	b, _ := e.Fields[name].(bool)
+	return b
+}
+
+// Decode unmarshals the whole frame into v.
+func (e Event) Decode(v interface{}) error {
+	return json.Unmarshal(e.Raw, v)
+}
+
+// Client is one WebSocket connection to the server.
+type Client struct {
+	Identity *Identity
+	Nickname string // Assigned in welcome
+	Token    string // Session token for the HTTP endpoints
+
+	baseURL string
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+	events  chan Event
+	closed  chan struct{} // Closed when the server ends the connection
+}
+
+// Dial connects to the server at baseURL (e.g. an httptest.Server URL)
+// without registering.
+func Dial(baseURL string, id *Identity) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.Path = "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		Identity: id,
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		conn:     conn,
+		events:   make(chan Event, 1024),
+		closed:   make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// Connect dials and registers with the proposed nickname, returning the welcome event.
+func Connect(baseURL string, id *Identity, nickname string) (*Client, Event, error) {
+	c, err := Dial(baseURL, id)
+	if err != nil {
+		return nil, Event{}, err
+	}
+	welcome, err := c.Register(nickname)
+	if err != nil {
+		c.Close()
+		return nil, Event{}, err
+	}
+	return c, welcome, nil
+}
+
+func (c *Client) readLoop() {
+	defer close(c.closed)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		e := Event{Raw: data}
+		if err := json.Unmarshal(data, &e.Fields); err != nil {
+			continue
+		}
+		e.Type, _ = e.Fields["type"].(string)
+		if e.Type == "challenge" {
+			c.answerChallenge(e)
+			continue
+		}
+		c.events <- e
+	}
+}
+
+func (c *Client) answerChallenge(e Event) {
+	ciphertext, err := base64.StdEncoding.DecodeString(e.String("data"))
+	if err != nil {
+		return
+	}
+	nonce, err := rsa.DecryptPKCS1v15(rand.Reader, c.Identity.key, ciphertext)
+	if err != nil {
+		return
+	}
+	c.Send(map[string]interface{}{"type": "challengeResponse", "data": string(nonce)})
+}
+
+// Register sends a register request and waits for welcome. A registerError
+// is returned as an error.
+func (c *Client) Register(nickname string) (Event, error) {
+	err := c.Send(map[string]interface{}{
+		"type": "register", "clientID": c.Identity.ClientID, "publicKey": c.Identity.PublicKey,
+		"proposedNickname": nickname, "version": 2,
+	})
+	if err != nil {
+		return Event{}, err
+	}
+	e, err := c.Expect("welcome", "registerError")
+	if err != nil {
+		return Event{}, err
+	}
+	if e.Type == "registerError" {
+		return e, fmt.Errorf("registration rejected: %s", e.String("data"))
+	}
+	c.Nickname = e.String("nickname")
+	c.Token = e.String("token")
+	return e, nil
+}
+
+// Send writes one frame.
+func (c *Client) Send(msg interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteJSON(msg)
+}
+
+// PrivateMessage sends data to one user.
+func (c *Client) PrivateMessage(to, data string) error {
+	return c.Send(map[string]interface{}{"type": "privateMessage", "to": to, "data": data})
+}
+
+// GroupMessage sends data to a room, or to the global group if room is "".
+func (c *Client) GroupMessage(room, data string) error {
+	msg := map[string]interface{}{"type": "groupMessage", "data": data}
+	if room != "" {
+		msg["room"] = room
+	}
+	return c.Send(msg)
+}
+
+// FileShare announces an uploaded file to a user, or to the global group if to is "group".
+func (c *Client) FileShare(to, uuid, data string) error {
+	return c.Send(map[string]interface{}{"type": "fileShare", "to": to, "uuid": uuid, "data": data})
+}
+
+// Expect waits up to DefaultTimeout for an event of one of the given types,
+// discarding any others that arrive first.
+func (c *Client) Expect(types ...string) (Event, error) {
+	return c.ExpectWithin(DefaultTimeout, types...)
+}
+
+// ExpectWithin is Expect with an explicit timeout.
+func (c *Client) ExpectWithin(timeout time.Duration, types ...string) (Event, error) {
+	deadline := time.After(timeout)
+	for {
+		var e Event
+		select {
+		case e = <-c.events:
+		case <-c.closed:
+			// 连接关闭前收到的事件仍可能留在缓冲区中
+			select {
+			case e = <-c.events:
+			default:
+				return Event{}, fmt.Errorf("connection closed while waiting for %v", types)
+			}
+		case <-deadline:
+			return Event{}, fmt.Errorf("timed out waiting for %v", types)
+		}
+		for _, t := range types {
+			if e.Type == t {
+				return e, nil
+			}
+		}
+	}
+}
+
+// ExpectNone fails if an event of the given type arrives within d.
+func (c *Client) ExpectNone(d time.Duration, eventType string) error {
+	e, err := c.ExpectWithin(d, eventType)
+	if err == nil {
+		return fmt.Errorf("unexpected %s event: %s", eventType, e.Raw)
+	}
+	return nil
+}
+
+// Closed is closed once the server has ended the connection.
+func (c *Client) Closed() <-chan struct{} {
+	return c.closed
+}
+
+// Close ends the connection and waits for the read loop to stop.
+func (c *Client) Close() {
+	c.conn.Close()
+	<-c.closed
+}
+
+// Upload sends content through /upload/start, /upload/chunk and
+// /upload/finish in chunks of chunkSize bytes and returns the file's UUID.
+func (c *Client) Upload(content []byte, chunkSize int) (string, error) {
+	if chunkSize <= 0 {
+		chunkSize = len(content) + 1
+	}
+	var started struct {
+		UUID string `json:"uuid"`
+	}
+	if err := c.postJSON("/upload/start", map[string]int{"size": len(content)}, &started); err != nil {
+		return "", err
+	}
+	for offset := 0; offset < len(content); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+		path := "/upload/chunk?uuid=" + started.UUID + "&offset=" + strconv.Itoa(offset)
+		req, err := c.newRequest("POST", path, bytes.NewReader(content[offset:end]))
+		if err != nil {
+			return "", err
+		}
+		if err := do(req, nil); err != nil {
+			return "", err
+		}
+	}
+	body := map[string]interface{}{"uuid": started.UUID, "size": len(content)}
+	if err := c.postJSON("/upload/finish", body, nil); err != nil {
+		return "", err
+	}
+	return started.UUID, nil
+}
+
+// Download fetches a file and returns the HTTP status with the body.
+func (c *Client) Download(uuid string) (int, []byte, error) {
+	return c.DownloadFrom(uuid, 0)
+}
+
+// DownloadFrom fetches a file from offset onwards with a Range request, the
+// way an interrupted download is resumed. Offset 0 fetches the whole file.
+func (c *Client) DownloadFrom(uuid string, offset int64) (int, []byte, error) {
+	req, err := c.newRequest("GET", "/download/"+uuid, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Session-Token", c.Token)
+	return req, nil
+}
+
+func (c *Client) postJSON(path string, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest("POST", path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return do(req, out)
+}
+
+// do performs the request and decodes a JSON response into out, turning
+// non-2xx statuses into errors.
+func do(req *http.Request, out interface{}) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, bytes.TrimSpace(data))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return errors.New("decoding " + req.URL.Path + " response: " + err.Error())
+	}
+	return nil
+}
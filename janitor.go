@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 后台清理：回收长时间无进展的 .part 文件，以及上传完成却从未被 fileShare 引用的文件
+
+// JanitorStats counts what the upload janitor has reclaimed since startup.
+type JanitorStats struct {
+	Runs             int64
+	PartsReclaimed   int64
+	OrphansReclaimed int64
+	BytesReclaimed   int64
+}
+
+func (h *Hub) cleanupAbandonedUploads(dir string) {
+	ticker := time.NewTicker(h.janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		h.expireFiles(now)
+		h.reclaimUploads(dir, now)
+	}
+}
+
+// reclaimCandidate is a file the janitor is about to delete.
+type reclaimCandidate struct {
+	path   string
+	reason string
+	part   bool
+	upload *Upload // Removed from uploads while the file is deleted; nil for untracked files
+	uuid   string
+}
+
+// reclaimUploads performs a single janitor pass. Candidates are picked under
+// filesMu, but the directory scan and the deletions happen without it so a
+// slow disk does not stall the hub.
+func (h *Hub) reclaimUploads(dir string, now time.Time) {
+	// 目录中既不在 uploads 也不在 fileRegistry 里的文件（例如上次异常退出遗留的）
+	var stale []string
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Janitor could not read %s: %v", dir, err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if fi, err := entry.Info(); err == nil && now.Sub(fi.ModTime()) > h.orphanedFileTTL {
+			stale = append(stale, entry.Name())
+		}
+	}
+
+	h.filesMu.Lock()
+	h.janitorStats.Runs++
+	var candidates []reclaimCandidate
+	for uuid, upload := range h.uploads {
+		switch {
+		case !upload.Finished && !upload.writing && now.Sub(upload.LastActivity) > h.abandonedUploadTTL:
+			candidates = append(candidates, reclaimCandidate{filepath.Join(dir, uuid+".part"), "upload abandoned", true, upload, uuid})
+		case upload.Finished && h.fileRegistry[uuid] == nil && now.Sub(upload.FinishedAt) > h.orphanedFileTTL:
+			candidates = append(candidates, reclaimCandidate{filepath.Join(dir, uuid), "finished upload was never shared", false, upload, uuid})
+		default:
+			continue
+		}
+		// 先从 uploads 中摘除，删除期间既不能续传也不能被分享
+		delete(h.uploads, uuid)
+	}
+	for _, name := range stale {
+		uuid := strings.TrimSuffix(name, ".part")
+		if _, ok := h.uploads[uuid]; ok {
+			continue
+		}
+		if _, ok := h.fileRegistry[uuid]; ok {
+			continue
+		}
+		candidates = append(candidates, reclaimCandidate{filepath.Join(dir, name), "untracked file", strings.HasSuffix(name, ".part"), nil, uuid})
+	}
+	h.filesMu.Unlock()
+
+	var parts, orphans, bytes int64
+	var failed []reclaimCandidate
+	for _, c := range candidates {
+		var size int64
+		if fi, err := os.Stat(c.path); err == nil {
+			size = fi.Size()
+		}
+		if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Janitor could not remove %s: %v", c.path, err)
+			failed = append(failed, c)
+			continue
+		}
+		log.Printf("Janitor reclaimed %s (%d bytes): %s", c.path, size, c.reason)
+		bytes += size
+		if c.part {
+			parts++
+		} else {
+			orphans++
+		}
+	}
+
+	h.filesMu.Lock()
+	defer h.filesMu.Unlock()
+	for _, c := range failed {
+		if c.upload != nil {
+			h.uploads[c.uuid] = c.upload
+		}
+	}
+	h.releaseDiskLocked(bytes)
+	h.janitorStats.PartsReclaimed += parts
+	h.janitorStats.OrphansReclaimed += orphans
+	h.janitorStats.BytesReclaimed += bytes
+	if parts+orphans > 0 {
+		log.Printf("Janitor pass reclaimed %d partial and %d orphaned file(s), %d bytes (totals: %d partial, %d orphaned, %d bytes)",
+			parts, orphans, bytes, h.janitorStats.PartsReclaimed, h.janitorStats.OrphansReclaimed, h.janitorStats.BytesReclaimed)
+	}
+}
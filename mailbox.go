@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// 离线信箱：私聊目标已断线但会话仍保留时，暂存已加密的消息，待其重连后投递
+const mailboxMaxMessages = 100
+
+const (
+	deliveryDelivered = "delivered" // Handed to the recipient's live connection
+	deliverySent      = "sent"      // Relayed to a group or room
+	deliveryQueued    = "queued"
+	deliveryFailed    = "failed"
+)
+
+type queuedMessage struct {
+	ID       int64
+	Payload  []byte // Marshalled privateMessage, relayed verbatim
+	From     string // Sender's ClientID, notified once the message is delivered
+	QueuedAt time.Time
+}
+
+// findOfflineSessionLocked looks up a disconnected session by nickname. Caller must hold mutex.
+func (h *Hub) findOfflineSessionLocked(nickname string) *Session {
+	if nickname == "" {
+		return nil
+	}
+	for _, session := range h.sessions {
+		if session.Client == nil && session.Nickname == nickname {
+			return session
+		}
+	}
+	return nil
+}
+
+// clientIDOfLocked resolves a nickname, online or of an offline session, to
+// its ClientID, or "" if there is none. Caller must hold mutex.
+func (h *Hub) clientIDOfLocked(nickname string) string {
+	if c, ok := h.nicknames[nickname]; ok {
+		return c.clientID
+	}
+	if session := h.findOfflineSessionLocked(nickname); session != nil {
+		return session.ClientID
+	}
+	return ""
+}
+
+// pruneMailboxLocked drops messages older than mailboxMaxAge. Caller must hold mutex.
+func (h *Hub) pruneMailboxLocked(session *Session, now time.Time) {
+	kept := session.Mailbox[:0]
+	for _, m := range session.Mailbox {
+		if now.Sub(m.QueuedAt) <= h.mailboxMaxAge {
+			kept = append(kept, m)
+		}
+	}
+	if dropped := len(session.Mailbox) - len(kept); dropped > 0 {
+		log.Printf("Dropped %d expired queued message(s) for %s", dropped, session.Nickname)
+	}
+	session.Mailbox = kept
+}
+
+// enqueueMessageLocked stores a message for an offline session. Caller must hold mutex.
+func (h *Hub) enqueueMessageLocked(session *Session, fromClientID string, id int64, payload []byte) bool {
+	now := time.Now()
+	h.pruneMailboxLocked(session, now)
+	if len(session.Mailbox) >= mailboxMaxMessages {
+		return false
+	}
+	session.Mailbox = append(session.Mailbox, queuedMessage{ID: id, Payload: payload, From: fromClientID, QueuedAt: now})
+	return true
+}
+
+// deliverMailbox 在重连时投递离线期间积压的消息；写出后通过 "delivered" 事件通知仍在线的发送者
+func (h *Hub) deliverMailbox(client *Client) {
+	h.mutex.Lock()
+	session, ok := h.sessions[client.clientID]
+	if !ok || len(session.Mailbox) == 0 {
+		h.mutex.Unlock()
+		return
+	}
+	h.pruneMailboxLocked(session, time.Now())
+	pending := session.Mailbox
+	session.Mailbox = nil
+	h.mutex.Unlock()
+
+	if len(pending) > 0 {
+		log.Printf("Delivering %d queued message(s) to %s", len(pending), client.nickname)
+	}
+	for _, m := range pending {
+		h.relayMessage([]*Client{client}, m.Payload, m.ID, m.From)
+	}
+}
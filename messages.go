@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// 服务器为每条转发的 privateMessage / groupMessage / fileShare 分配单调递增的 ID 和时间戳，
+// 并记住最近消息的路由信息，用于校验 ack 并向发送者回报送达状态。
+const recentMessageLimit = 10000
+
+type messageRoute struct {
+	ID       int64
+	Type     string // privateMessage, groupMessage or fileShare
+	SenderID string // Sender's ClientID
+	Kind     string // historyConvGroup, historyConvRoom or historyConvPrivate
+	Room     string
+	ToID     string // Recipient's ClientID for private messages
+	ThreadID int64  // Root of the thread the message replies in, or 0
+}
+
+// outboundMessage is what travels through Client.send. onFlush, if set,
+// runs in the writePump once the frame has been written to the socket;
+// a non-zero closeCode makes the writePump close the connection right after it.
+type outboundMessage struct {
+	data      []byte
+	onFlush   func()
+	closeCode int
+}
+
+func (h *Hub) nextMessageID() int64 {
+	return atomic.AddInt64(&h.lastMessageID, 1)
+}
+
+// seedMessageIDs makes sure new IDs continue after those already in stored history.
+func (h *Hub) seedMessageIDs(last int64) {
+	for {
+		current := atomic.LoadInt64(&h.lastMessageID)
+		if last <= current || atomic.CompareAndSwapInt64(&h.lastMessageID, current, last) {
+			return
+		}
+	}
+}
+
+// stampMessage assigns a fresh ID and server timestamp.
+func (h *Hub) stampMessage(msg *Message) {
+	msg.ID = h.nextMessageID()
+	msg.Timestamp = time.Now().UnixMilli()
+}
+
+// rememberMessageLocked records the route of a relayed message. Caller must hold messagesMu.
+func (h *Hub) rememberMessageLocked(route *messageRoute) {
+	if len(h.recentOrder) >= recentMessageLimit {
+		delete(h.recentMessages, h.recentOrder[0])
+		delete(h.threads, h.recentOrder[0])
+		h.recentOrder = h.recentOrder[1:]
+	}
+	h.recentMessages[route.ID] = route
+	h.recentOrder = append(h.recentOrder, route.ID)
+}
+
+func (h *Hub) rememberMessage(route *messageRoute) {
+	h.messagesMu.Lock()
+	h.rememberMessageLocked(route)
+	h.messagesMu.Unlock()
+}
+
+// canReceiveLocked reports whether the ClientID was an intended recipient of the route. Caller must hold mutex.
+func (h *Hub) canReceiveLocked(route *messageRoute, clientID string) bool {
+	switch route.Kind {
+	case historyConvGroup:
+		return clientID != route.SenderID
+	case historyConvRoom:
+		room, ok := h.rooms[route.Room]
+		return ok && room.Members[clientID] && clientID != route.SenderID
+	case historyConvPrivate:
+		return clientID == route.ToID
+	}
+	return false
+}
+
+// relayMessage 将消息逐个发给接收者，并在每个接收者的 writePump 写出后通知发送者
+func (h *Hub) relayMessage(recipients []*Client, message []byte, id int64, senderID string) {
+	h.mutex.Lock()
+	names := make([]string, len(recipients))
+	for i, recipient := range recipients {
+		names[i] = recipient.nickname
+	}
+	h.mutex.Unlock()
+	for i, recipient := range recipients {
+		nickname := names[i]
+		sendTrackedMessage(recipient, message, func() {
+			h.notifyDelivered(senderID, id, nickname, false)
+		})
+	}
+}
+
+// notifyDelivered sends a "delivered" event to the sender if they are still connected.
+func (h *Hub) notifyDelivered(senderID string, id int64, recipient string, acked bool) {
+	h.mutex.Lock()
+	var sender *Client
+	if session, ok := h.sessions[senderID]; ok {
+		sender = session.Client
+	}
+	h.mutex.Unlock()
+	if sender == nil {
+		return
+	}
+	response := map[string]interface{}{"type": "delivered", "id": id, "to": recipient, "acked": acked}
+	if msgBytes, err := json.Marshal(response); err == nil {
+		sendMessageToClient(sender, msgBytes)
+	}
+}
+
+// handleAck 接收者确认收到消息后，转告原发送者
+func (h *Hub) handleAck(client *Client, msg Message) {
+	h.messagesMu.Lock()
+	route, ok := h.recentMessages[msg.ID]
+	h.messagesMu.Unlock()
+	if !ok {
+		sendError(client, msg, errNotFound, "消息不存在")
+		return
+	}
+	h.mutex.Lock()
+	valid := h.canReceiveLocked(route, client.clientID)
+	nickname := client.nickname
+	h.mutex.Unlock()
+	if !valid {
+		sendError(client, msg, errInvalidRequest, "你不是该消息的接收者")
+		return
+	}
+	h.notifyDelivered(route.SenderID, msg.ID, nickname, true)
+}
+
+type messageStatus struct {
+	Type      string `json:"type"`
+	ID        int64  `json:"id,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	To        string `json:"to,omitempty"`
+	Room      string `json:"room,omitempty"`
+	Status    string `json:"status"`
+	Data      string `json:"data,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// sendMessageStatus tells the sender the ID assigned to its message and
+// whether it went out live, was queued, or failed.
+func sendMessageStatus(client *Client, relayed Message, requestID, status, reason string) {
+	response := messageStatus{
+		Type: "messageStatus", ID: relayed.ID, Timestamp: relayed.Timestamp,
+		To: relayed.To, Room: relayed.Room, Status: status, Data: reason, RequestID: requestID,
+	}
+	if msgBytes, err := json.Marshal(response); err == nil {
+		sendMessageToClient(client, msgBytes)
+	}
+}
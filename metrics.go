@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// /metrics：手写的 Prometheus 文本格式 (version 0.0.4)，不依赖任何外部库。
+// 计数器在事件发生处累加，其余数值在抓取时从 Hub 的状态中读取。
+type serverMetrics struct {
+	relayedMu sync.Mutex
+	relayed   map[string]int64 // Message type -> messages relayed
+
+	bytesUploaded       int64 // accessed atomically
+	bytesDownloaded     int64
+	downloads           int64
+	sendBufferFullDrops int64
+	upgradeErrors       int64
+	rateLimited         int64
+}
+
+// countRelayed records one message of the given type accepted for delivery.
+func (m *serverMetrics) countRelayed(messageType string) {
+	m.relayedMu.Lock()
+	m.relayed[messageType]++
+	m.relayedMu.Unlock()
+}
+
+// countingWriter counts the body bytes written through an http.ResponseWriter.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (mw metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (mw metricsWriter) value(name string, labels string, v interface{}) {
+	if labels != "" {
+		fmt.Fprintf(mw.w, "%s{%s} %v\n", name, labels, v)
+	} else {
+		fmt.Fprintf(mw.w, "%s %v\n", name, v)
+	}
+}
+
+func (mw metricsWriter) single(name, kind, help string, v interface{}) {
+	mw.header(name, kind, help)
+	mw.value(name, "", v)
+}
+
+// escapeLabel escapes a label value as required by the text exposition format.
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func (h *Hub) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	connected := len(h.clients)
+	var live, dormant int
+	for _, s := range h.sessions {
+		if s.Client != nil {
+			live++
+		} else {
+			dormant++
+		}
+	}
+	roomCount := len(h.rooms)
+	h.mutex.Unlock()
+
+	h.filesMu.Lock()
+	var files, tombstones int
+	for _, info := range h.fileRegistry {
+		if info.Gone {
+			tombstones++
+		} else {
+			files++
+		}
+	}
+	var active, finished int
+	for _, u := range h.uploads {
+		if u.Finished {
+			finished++
+		} else {
+			active++
+		}
+	}
+	disk := h.diskUsage
+	janitor := h.janitorStats
+	h.filesMu.Unlock()
+
+	h.metrics.relayedMu.Lock()
+	relayed := make(map[string]int64, len(h.metrics.relayed))
+	types := make([]string, 0, len(h.metrics.relayed))
+	for t, n := range h.metrics.relayed {
+		relayed[t] = n
+		types = append(types, t)
+	}
+	h.metrics.relayedMu.Unlock()
+	sort.Strings(types)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := metricsWriter{w: w}
+
+	mw.single("chatroom_connected_clients", "gauge", "WebSocket connections currently open.", connected)
+	mw.header("chatroom_sessions", "gauge", "Sessions by state; dormant sessions are disconnected but not yet expired.")
+	mw.value("chatroom_sessions", `state="live"`, live)
+	mw.value("chatroom_sessions", `state="dormant"`, dormant)
+	mw.single("chatroom_rooms", "gauge", "Named rooms that exist.", roomCount)
+
+	mw.header("chatroom_messages_relayed_total", "counter", "Messages accepted for delivery, by type.")
+	for _, t := range types {
+		mw.value("chatroom_messages_relayed_total", fmt.Sprintf(`type="%s"`, escapeLabel(t)), relayed[t])
+	}
+
+	mw.single("chatroom_upload_bytes_total", "counter", "Bytes written to the uploads directory by chunk uploads.", atomic.LoadInt64(&h.metrics.bytesUploaded))
+	mw.single("chatroom_download_bytes_total", "counter", "Bytes sent by the download endpoint.", atomic.LoadInt64(&h.metrics.bytesDownloaded))
+	mw.single("chatroom_downloads_total", "counter", "Downloads started.", atomic.LoadInt64(&h.metrics.downloads))
+	mw.header("chatroom_files", "gauge", "Entries in the file registry; expired or revoked files are kept as tombstones for a while.")
+	mw.value("chatroom_files", `state="available"`, files)
+	mw.value("chatroom_files", `state="gone"`, tombstones)
+	mw.header("chatroom_uploads", "gauge", "Tracked uploads by state.")
+	mw.value("chatroom_uploads", `state="active"`, active)
+	mw.value("chatroom_uploads", `state="finished"`, finished)
+	mw.single("chatroom_disk_usage_bytes", "gauge", "Bytes stored or reserved in the uploads directory.", disk)
+	mw.single("chatroom_disk_budget_bytes", "gauge", "Configured disk budget for the uploads directory (0 = unlimited).", h.uploadLimits.DiskBudget)
+
+	mw.single("chatroom_janitor_runs_total", "counter", "Upload janitor passes.", janitor.Runs)
+	mw.header("chatroom_janitor_reclaimed_files_total", "counter", "Files deleted by the upload janitor, by reason.")
+	mw.value("chatroom_janitor_reclaimed_files_total", `reason="abandoned"`, janitor.PartsReclaimed)
+	mw.value("chatroom_janitor_reclaimed_files_total", `reason="orphaned"`, janitor.OrphansReclaimed)
+	mw.single("chatroom_janitor_reclaimed_bytes_total", "counter", "Bytes freed by the upload janitor.", janitor.BytesReclaimed)
+
+	mw.single("chatroom_send_buffer_full_disconnects_total", "counter", "Clients disconnected because their send channel was full.", atomic.LoadInt64(&h.metrics.sendBufferFullDrops))
+	mw.single("chatroom_websocket_upgrade_errors_total", "counter", "Failed WebSocket upgrades.", atomic.LoadInt64(&h.metrics.upgradeErrors))
+	mw.single("chatroom_rate_limited_total", "counter", "Frames dropped by per-client rate limits.", atomic.LoadInt64(&h.metrics.rateLimited))
+	mw.single("chatroom_start_time_seconds", "gauge", "Unix time the server started.", h.startTime.Unix())
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 管理员/版主：持有 moderatorSecret 的用户可通过 moderatorLogin 获得权限，
+// 公钥指纹在 moderatorKeys 列表中的用户注册后自动成为版主。
+// 版主可以 kick（断开）、ban（按 ClientID、公钥指纹或 IP 封禁，可设时长）和 mute（禁言）。
+const (
+	banByClientID    = "clientID"
+	banByFingerprint = "fingerprint"
+	banByIP          = "ip"
+)
+
+// Ban blocks registration for one ClientID, public key fingerprint or IP address.
+type Ban struct {
+	Kind   string    `json:"kind"`
+	Value  string    `json:"value"`
+	Until  time.Time `json:"until,omitempty"` // Zero means permanent
+	Reason string    `json:"reason,omitempty"`
+	By     string    `json:"by"`
+}
+
+func banKey(kind, value string) string { return kind + ":" + value }
+
+// publicKeyFingerprint returns the hex SHA-256 of the key's DER encoding, or "" if it cannot be parsed.
+func publicKeyFingerprint(pemKey string) string {
+	pub, err := parseRSAPublicKey(pemKey)
+	if err != nil {
+		return ""
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// remoteIP extracts the peer address of a request without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// activeBanLocked returns the ban matching any of the identities, dropping
+// expired ones along the way. Caller must hold mutex.
+func (h *Hub) activeBanLocked(clientID, fingerprint, ip string) *Ban {
+	now := time.Now()
+	for _, key := range []string{banKey(banByClientID, clientID), banKey(banByFingerprint, fingerprint), banKey(banByIP, ip)} {
+		ban, ok := h.bans[key]
+		if !ok {
+			continue
+		}
+		if !ban.Until.IsZero() && now.After(ban.Until) {
+			delete(h.bans, key)
+			continue
+		}
+		return ban
+	}
+	return nil
+}
+
+// isMutedLocked reports whether the ClientID may not send messages right now. Caller must hold mutex.
+func (h *Hub) isMutedLocked(clientID string) bool {
+	until, ok := h.mutes[clientID]
+	if !ok {
+		return false
+	}
+	if !until.IsZero() && time.Now().After(until) {
+		delete(h.mutes, clientID)
+		return false
+	}
+	return true
+}
+
+// banReason is the text shown to a banned user.
+func banReason(ban *Ban) string {
+	reason := "你已被封禁"
+	if !ban.Until.IsZero() {
+		reason += "，解封时间 " + ban.Until.Format("2006-01-02 15:04")
+	}
+	if ban.Reason != "" {
+		reason += "：" + ban.Reason
+	}
+	return reason
+}
+
+// rejectMuted tells a muted sender its message was dropped and reports whether it was.
+func (h *Hub) rejectMuted(client *Client, msg Message) bool {
+	h.mutex.Lock()
+	muted := h.isMutedLocked(client.clientID)
+	h.mutex.Unlock()
+	if muted {
+		sendMessageStatus(client, Message{To: msg.To, Room: msg.Room}, msg.RequestID, deliveryFailed, "你已被禁言")
+	}
+	return muted
+}
+
+func sendModerationError(client *Client, request Message, code, reason string) {
+	rejectOperation(client, request, code, reason, map[string]string{"type": "moderationError"})
+}
+
+// disconnectClient sends a final event and closes the connection once it has been written.
+func disconnectClient(client *Client, eventType, reason string) {
+	response := map[string]string{"type": eventType, "data": reason}
+	if msgBytes, err := json.Marshal(response); err == nil {
+		if client.queue(outboundMessage{data: msgBytes, closeCode: websocket.ClosePolicyViolation}) {
+			return
+		}
+	}
+	client.conn.Close()
+}
+
+// handleModeratorLogin grants moderator rights to a client that knows the secret.
+func (h *Hub) handleModeratorLogin(client *Client, msg Message) {
+	a, b := sha256.Sum256([]byte(msg.Data)), sha256.Sum256([]byte(h.moderatorSecret))
+	if h.moderatorSecret == "" || subtle.ConstantTimeCompare(a[:], b[:]) != 1 {
+		log.Printf("Failed moderator login from %s (%s)", client.nickname, client.ip)
+		sendModerationError(client, msg, errForbidden, "版主密码错误")
+		return
+	}
+	h.mutex.Lock()
+	client.moderator = true
+	h.mutex.Unlock()
+	log.Printf("%s is now a moderator", client.nickname)
+	if msgBytes, err := json.Marshal(map[string]interface{}{"type": "moderator", "granted": true}); err == nil {
+		sendMessageToClient(client, msgBytes)
+	}
+}
+
+// moderationTarget describes who a moderation command applies to.
+type moderationTarget struct {
+	nickname    string
+	clientID    string
+	fingerprint string
+	ip          string
+	moderator   bool
+}
+
+// resolveTargetLocked looks up a user by nickname, live or dormant. Caller must hold mutex.
+func (h *Hub) resolveTargetLocked(nickname string) (moderationTarget, bool) {
+	session := h.findSessionByNicknameLocked(nickname)
+	if session == nil {
+		return moderationTarget{}, false
+	}
+	target := moderationTarget{
+		nickname:    session.Nickname,
+		clientID:    session.ClientID,
+		fingerprint: publicKeyFingerprint(session.PublicKey),
+		ip:          session.IP,
+	}
+	if session.Client != nil {
+		target.moderator = session.Client.moderator
+	}
+	return target, true
+}
+
+// matchingClientsLocked returns the connected clients a ban applies to. Caller must hold mutex.
+func (h *Hub) matchingClientsLocked(ban *Ban) []*Client {
+	var matched []*Client
+	for c := range h.clients {
+		if c.moderator {
+			continue
+		}
+		switch {
+		case ban.Kind == banByClientID && c.clientID == ban.Value,
+			ban.Kind == banByIP && c.ip == ban.Value,
+			ban.Kind == banByFingerprint && publicKeyFingerprint(c.publicKey) == ban.Value:
+			matched = append(matched, c)
+		}
+	}
+	return matched
+}
+
+// handleModeration processes kick, ban, unban, mute and unmute from a moderator.
+// Targets are given by nickname in "to"; ban and unban also accept a raw
+// ClientID, fingerprint or IP in "target" together with "banType".
+func (h *Hub) handleModeration(client *Client, msg Message) {
+	h.mutex.Lock()
+	if !client.moderator {
+		h.mutex.Unlock()
+		sendModerationError(client, msg, errForbidden, "你没有版主权限")
+		return
+	}
+	moderator := client.nickname
+
+	var target moderationTarget
+	if msg.To != "" {
+		var ok bool
+		if target, ok = h.resolveTargetLocked(msg.To); !ok {
+			h.mutex.Unlock()
+			sendModerationError(client, msg, errNotFound, "用户不存在")
+			return
+		}
+		if target.clientID == client.clientID || target.moderator {
+			h.mutex.Unlock()
+			sendModerationError(client, msg, errForbidden, "不能对自己或其他版主执行该操作")
+			return
+		}
+	} else if msg.Target == "" || (msg.Type != "ban" && msg.Type != "unban") {
+		h.mutex.Unlock()
+		sendModerationError(client, msg, errInvalidRequest, "缺少目标用户")
+		return
+	}
+
+	var until time.Time
+	if msg.Duration > 0 {
+		until = time.Now().Add(time.Duration(msg.Duration) * time.Second)
+	}
+
+	var disconnect []*Client
+	disconnectEvent, disconnectReason := "kicked", msg.Data
+	event := map[string]interface{}{"type": "moderation", "action": msg.Type, "moderator": moderator, "target": target.nickname}
+	if msg.Data != "" {
+		event["reason"] = msg.Data
+	}
+	if !until.IsZero() {
+		event["until"] = until.UnixMilli()
+	}
+
+	switch msg.Type {
+	case "kick":
+		if c, ok := h.nicknames[target.nickname]; ok {
+			disconnect = append(disconnect, c)
+		}
+	case "ban", "unban":
+		kind := msg.BanType
+		if kind == "" {
+			kind = banByClientID
+		}
+		value := msg.Target
+		switch kind {
+		case banByClientID:
+			if value == "" {
+				value = target.clientID
+			}
+		case banByFingerprint:
+			if value == "" {
+				value = target.fingerprint
+			}
+			value = strings.ToLower(strings.ReplaceAll(value, ":", ""))
+		case banByIP:
+			if value == "" {
+				value = target.ip
+			}
+		default:
+			h.mutex.Unlock()
+			sendModerationError(client, msg, errInvalidRequest, "未知的封禁类型")
+			return
+		}
+		if value == "" {
+			h.mutex.Unlock()
+			sendModerationError(client, msg, errInvalidRequest, "无法确定该用户的"+kind)
+			return
+		}
+		if target.nickname == "" {
+			event["target"] = value
+		}
+		event["banType"] = kind
+		if msg.Type == "unban" {
+			delete(h.bans, banKey(kind, value))
+			break
+		}
+		ban := &Ban{Kind: kind, Value: value, Until: until, Reason: msg.Data, By: moderator}
+		h.bans[banKey(kind, value)] = ban
+		disconnect = h.matchingClientsLocked(ban)
+		disconnectEvent, disconnectReason = "banned", banReason(ban)
+	case "mute":
+		h.mutes[target.clientID] = until
+	case "unmute":
+		delete(h.mutes, target.clientID)
+	}
+	h.mutex.Unlock()
+
+	log.Printf("Moderation: %s %s %v", moderator, msg.Type, event["target"])
+	for _, c := range disconnect {
+		disconnectClient(c, disconnectEvent, disconnectReason)
+	}
+
+	// 在房间内执行的操作只通知该房间，否则通知所有人
+	room := ""
+	if msg.Room != "" && h.isRoomMember(msg.Room, client) {
+		room = msg.Room
+		event["room"] = room
+	}
+	msgBytes, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	if room != "" {
+		h.broadcastToRoom(room, msgBytes, nil)
+		return
+	}
+	for _, c := range h.groupClients(nil) {
+		sendMessageToClient(c, msgBytes)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// 可选的持久化模式：关机时把 fileRegistry、sessions 等状态快照到本地文件，
+// 启动时再加载回来，这样重启更新时已分享的文件不会丢失。
+
+type sessionSnapshot struct {
+	ClientID      string           `json:"clientID"`
+	Nickname      string           `json:"nickname"`
+	PublicKey     string           `json:"publicKey"`
+	LastSeen      time.Time        `json:"lastSeen"`
+	Mailbox       []queuedMessage  `json:"mailbox,omitempty"`
+	ReadMarks     map[string]int64 `json:"readMarks,omitempty"`
+	UploadedBytes int64            `json:"uploadedBytes,omitempty"`
+	IP            string           `json:"ip,omitempty"`
+}
+
+type stateSnapshot struct {
+	SavedAt       time.Time            `json:"savedAt"`
+	LastMessageID int64                `json:"lastMessageID"`
+	Sessions      []sessionSnapshot    `json:"sessions"`
+	Rooms         map[string]*Room     `json:"rooms"`
+	Files         map[string]*FileInfo `json:"files"`
+	Uploads       map[string]*Upload   `json:"uploads"`
+	Bans          map[string]*Ban      `json:"bans,omitempty"`
+	Mutes         map[string]time.Time `json:"mutes,omitempty"`
+}
+
+// saveState writes the snapshot atomically via a temporary file.
+func (h *Hub) saveState(path string) error {
+	h.mutex.Lock()
+	h.filesMu.Lock()
+	snapshot := stateSnapshot{
+		SavedAt:       time.Now(),
+		LastMessageID: atomic.LoadInt64(&h.lastMessageID),
+		Sessions:      make([]sessionSnapshot, 0, len(h.sessions)),
+		Rooms:         h.rooms,
+		Files:         h.fileRegistry,
+		Uploads:       h.uploads,
+		Bans:          h.bans,
+		Mutes:         h.mutes,
+	}
+	for _, s := range h.sessions {
+		snapshot.Sessions = append(snapshot.Sessions, sessionSnapshot{
+			ClientID: s.ClientID, Nickname: s.Nickname, PublicKey: s.PublicKey, LastSeen: s.LastSeen,
+			Mailbox: s.Mailbox, ReadMarks: s.ReadMarks, UploadedBytes: h.uploadedBytes[s.ClientID], IP: s.IP,
+		})
+	}
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	h.filesMu.Unlock()
+	h.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	log.Printf("Saved state for %d session(s) and %d file(s) to %s", len(snapshot.Sessions), len(snapshot.Files), path)
+	return nil
+}
+
+// restoreReferences fills in the ClientIDs missing from references saved by
+// older versions, using the nicknames the saved sessions had. References that
+// cannot be resolved are dropped: restored sessions are all offline, and a
+// nickname alone would grant the file to whoever registers it first.
+func restoreReferences(refs []*FileReference, idOf map[string]string) []*FileReference {
+	var kept []*FileReference
+	for _, ref := range refs {
+		if ref.SenderID == "" {
+			ref.SenderID = idOf[ref.Sender]
+		}
+		// 旧快照没有 Group 字段，群聊分享只能从没有接收者 ID 的 "group" 引用认出
+		if ref.Room == "" && ref.RecipientID == "" && ref.Recipient == groupRecipient {
+			ref.Group = true
+		}
+		private := ref.Room == "" && !ref.Group
+		if private && ref.RecipientID == "" {
+			ref.RecipientID = idOf[ref.Recipient]
+		}
+		if ref.SenderID == "" || (private && ref.RecipientID == "") {
+			log.Printf("Dropping restored file reference %s->%s with no matching session", ref.Sender, ref.Recipient)
+			continue
+		}
+		kept = append(kept, ref)
+	}
+	return kept
+}
+
+// loadState restores a snapshot written by saveState. A missing file is not an error.
+func (h *Hub) loadState(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snapshot stateSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	now := time.Now()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.filesMu.Lock()
+	defer h.filesMu.Unlock()
+
+	for _, s := range snapshot.Sessions {
+		// 重新给每个会话完整的超时时间来重连
+		h.sessions[s.ClientID] = &Session{
+			ClientID: s.ClientID, Nickname: s.Nickname, PublicKey: s.PublicKey, LastSeen: now,
+			Mailbox: s.Mailbox, ReadMarks: s.ReadMarks, IP: s.IP,
+		}
+		if s.UploadedBytes > 0 {
+			h.uploadedBytes[s.ClientID] = s.UploadedBytes
+		}
+	}
+	for name, room := range snapshot.Rooms {
+		if room.Members == nil {
+			room.Members = make(map[string]bool)
+		}
+		h.rooms[name] = room
+	}
+	idOf := make(map[string]string, len(snapshot.Sessions))
+	for _, s := range snapshot.Sessions {
+		idOf[s.Nickname] = s.ClientID
+	}
+	for uuid, info := range snapshot.Files {
+		if !isValidUUID(uuid) {
+			continue
+		}
+		if _, err := os.Stat(info.Path); err != nil && !info.Gone {
+			log.Printf("Dropping file UUID %s from restored state: %v", uuid, err)
+			continue
+		}
+		info.References = restoreReferences(info.References, idOf)
+		h.fileRegistry[uuid] = info
+	}
+	for uuid, upload := range snapshot.Uploads {
+		if !isValidUUID(uuid) {
+			continue
+		}
+		// 未完成的上传可以在重启后继续，给它们重新计时
+		upload.LastActivity = now
+		h.uploads[uuid] = upload
+	}
+	for key, ban := range snapshot.Bans {
+		if ban.Until.IsZero() || now.Before(ban.Until) {
+			h.bans[key] = ban
+		}
+	}
+	for clientID, until := range snapshot.Mutes {
+		if until.IsZero() || now.Before(until) {
+			h.mutes[clientID] = until
+		}
+	}
+	h.seedMessageIDs(snapshot.LastMessageID)
+
+	log.Printf("Restored %d session(s), %d room(s) and %d file(s) from %s (saved %s)",
+		len(snapshot.Sessions), len(snapshot.Rooms), len(h.fileRegistry), path, snapshot.SavedAt.Format(time.RFC3339))
+	return nil
+}
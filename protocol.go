@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// 协议版本：客户端在 register 中携带 version，服务器在 welcome 中回复协商后的版本。
+// 版本 1 是不带 version 字段的旧协议，失败的操作以 roomError、fileError 等各自的事件返回；
+// 版本 2 起所有失败都以统一的 error 事件返回，附带错误码和请求的 requestId。
+// 消息格式见 PROTOCOL.md。
+const (
+	minProtocolVersion = 1
+	protocolVersion    = 2 // Highest version this server speaks
+)
+
+// Error codes carried by "error" events.
+const (
+	errBadJSON            = "badJSON"        // The frame is not a JSON object
+	errUnknownType        = "unknownType"    // The type is not one the server handles
+	errNotRegistered      = "notRegistered"  // Only register and challengeResponse are allowed before registering
+	errInvalidRequest     = "invalidRequest" // A field is missing or malformed
+	errNotFound           = "notFound"       // The user, room or file does not exist
+	errForbidden          = "forbidden"      // The sender is not allowed to do this
+	errConflict           = "conflict"       // The name is already taken
+	errUnavailable        = "unavailable"    // The feature is disabled on this server
+	errInternal           = "internal"       // The server failed to carry out a valid request
+	errUnsupportedVersion = "unsupportedVersion"
+)
+
+// errorEvent is the generic failure reply. RequestType and RequestID identify
+// the frame that failed so clients can match the error to what they sent.
+type errorEvent struct {
+	Type        string `json:"type"`
+	Code        string `json:"code"`
+	Data        string `json:"data"`
+	RequestType string `json:"requestType,omitempty"`
+	RequestID   string `json:"requestId,omitempty"`
+}
+
+// negotiateVersion picks the protocol version for a register request; 0 means the client predates versioning.
+func negotiateVersion(requested int) (int, bool) {
+	switch {
+	case requested == 0:
+		return minProtocolVersion, true
+	case requested < minProtocolVersion:
+		return 0, false
+	case requested > protocolVersion:
+		return protocolVersion, true
+	}
+	return requested, true
+}
+
+// sendError sends a generic error event about the given request.
+func sendError(client *Client, request Message, code, reason string) {
+	response := errorEvent{Type: "error", Code: code, Data: reason, RequestType: request.Type, RequestID: request.RequestID}
+	if msgBytes, err := json.Marshal(response); err == nil {
+		sendMessageToClient(client, msgBytes)
+	}
+}
+
+// rejectOperation reports a failed request. Clients speaking version 2 or
+// later get a generic error; older clients get the legacy per-feature event.
+func rejectOperation(client *Client, request Message, code, reason string, legacy map[string]string) {
+	client.hub.mutex.Lock()
+	version := client.protocol
+	client.hub.mutex.Unlock()
+	if version >= 2 || legacy == nil {
+		sendError(client, request, code, reason)
+		return
+	}
+	legacy["data"] = reason
+	if msgBytes, err := json.Marshal(legacy); err == nil {
+		sendMessageToClient(client, msgBytes)
+	}
+}
+
+// rejectMalformed answers a frame that could not be decoded.
+func rejectMalformed(client *Client, err error) {
+	log.Printf("Malformed frame from %s: %v", client.nickname, err)
+	sendError(client, Message{}, errBadJSON, "消息不是有效的 JSON: "+err.Error())
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// 上传配额：单文件大小、每个会话的并发上传数与累计字节数，以及 uploads 目录的总磁盘预算。
+// 任一限制为 0 表示不限制。
+type UploadLimits struct {
+	MaxFileSize          int64
+	MaxConcurrentUploads int
+	SessionQuota         int64
+	DiskBudget           int64
+}
+
+type quotaInfo struct {
+	MaxFileSize          int64 `json:"maxFileSize"`
+	MaxConcurrentUploads int   `json:"maxConcurrentUploads"`
+	SessionQuota         int64 `json:"sessionQuota"`
+	SessionUsed          int64 `json:"sessionUsed"`
+}
+
+// quotaInfo describes the limits as they apply to one session.
+func (h *Hub) quotaInfo(clientID string) quotaInfo {
+	h.filesMu.Lock()
+	defer h.filesMu.Unlock()
+	return quotaInfo{
+		MaxFileSize:          h.uploadLimits.MaxFileSize,
+		MaxConcurrentUploads: h.uploadLimits.MaxConcurrentUploads,
+		SessionQuota:         h.uploadLimits.SessionQuota,
+		SessionUsed:          h.uploadedBytes[clientID],
+	}
+}
+
+// activeUploadsLocked counts the unfinished uploads owned by a ClientID. Caller must hold filesMu.
+func (h *Hub) activeUploadsLocked(clientID string) int {
+	count := 0
+	for _, upload := range h.uploads {
+		if upload.Owner == clientID && !upload.Finished {
+			count++
+		}
+	}
+	return count
+}
+
+// checkUploadSizeLocked returns a user-facing reason if growing an upload
+// from its current size by n bytes would break a limit. Caller must hold filesMu.
+func (h *Hub) checkUploadSizeLocked(clientID string, currentSize, n int64) string {
+	switch {
+	case h.uploadLimits.MaxFileSize > 0 && currentSize+n > h.uploadLimits.MaxFileSize:
+		return "File exceeds the maximum allowed size"
+	case h.uploadLimits.SessionQuota > 0 && h.uploadedBytes[clientID]+n > h.uploadLimits.SessionQuota:
+		return "Session upload quota exceeded"
+	case h.uploadLimits.DiskBudget > 0 && h.diskUsage+n > h.uploadLimits.DiskBudget:
+		return "Server storage is full"
+	}
+	return ""
+}
+
+// removeUploadFileLocked deletes a file from the uploads directory and
+// releases its bytes from the disk budget. Caller must hold filesMu.
+func (h *Hub) removeUploadFileLocked(path string) error {
+	fi, statErr := os.Stat(path)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if statErr == nil {
+		h.releaseDiskLocked(fi.Size())
+	}
+	return nil
+}
+
+// releaseDiskLocked subtracts n removed bytes from diskUsage. Caller must hold filesMu.
+func (h *Hub) releaseDiskLocked(n int64) {
+	h.diskUsage -= n
+	if h.diskUsage < 0 {
+		h.diskUsage = 0
+	}
+}
+
+// measureDiskUsage initialises diskUsage from whatever is already in the uploads directory.
+func (h *Hub) measureDiskUsage(dir string) {
+	var total int64
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			total += fi.Size()
+		}
+		return nil
+	})
+	h.filesMu.Lock()
+	h.diskUsage = total
+	h.filesMu.Unlock()
+	if total > 0 {
+		log.Printf("Uploads directory already holds %d bytes", total)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 防刷屏：每个连接对所有帧以及几类消息分别使用令牌桶限速。
+// 超限的消息被丢弃并发送 rateLimited 警告；短时间内反复超限会被临时禁言，继续超限则断开连接。
+
+// RateLimit allows Events per Per, with bursts of up to Events. It is written as "20/10s".
+type RateLimit struct {
+	Events int
+	Per    time.Duration
+}
+
+func (l RateLimit) String() string {
+	if l.Events == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%d/%s", l.Events, l.Per)
+}
+
+// Set parses "N/duration"; "0" disables the limit.
+func (l *RateLimit) Set(s string) error {
+	if strings.TrimSpace(s) == "0" {
+		*l = RateLimit{}
+		return nil
+	}
+	events, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return fmt.Errorf("rate limit %q must look like 20/10s", s)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(events))
+	if err != nil || n < 0 {
+		return fmt.Errorf("rate limit %q: invalid event count", s)
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(per))
+	if err != nil || d <= 0 {
+		return fmt.Errorf("rate limit %q: invalid interval", s)
+	}
+	*l = RateLimit{Events: n, Per: d}
+	return nil
+}
+
+func (l RateLimit) MarshalJSON() ([]byte, error) { return json.Marshal(l.String()) }
+
+func (l *RateLimit) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("rate limit must be a string such as \"20/10s\": %w", err)
+	}
+	return l.Set(s)
+}
+
+// 限速类别
+const (
+	rateClassFrames    = "frames" // Every websocket frame, whatever its type
+	rateClassMessages  = "messages"
+	rateClassNickname  = "nickname"
+	rateClassFileShare = "fileShare"
+)
+
+// rateClassOf maps a message type to its limited class, or "" if only the frame limit applies.
+func rateClassOf(messageType string) string {
+	switch messageType {
+	case "privateMessage", "groupMessage", "editMessage", "deleteMessage":
+		return rateClassMessages
+	case "changeNickname":
+		return rateClassNickname
+	case "fileShare":
+		return rateClassFileShare
+	}
+	return ""
+}
+
+// 升级处罚的阈值：在 strikeWindow 内累计的超限次数
+const (
+	strikeWindow     = time.Minute
+	strikesToMute    = 10
+	strikesToKick    = 30
+	floodMuteTimeout = time.Minute
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket for the time elapsed and spends one token if available.
+func (b *tokenBucket) take(limit RateLimit, now time.Time) bool {
+	capacity := float64(limit.Events)
+	if b.last.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * capacity / limit.Per.Seconds()
+		if b.tokens > capacity {
+			b.tokens = capacity
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// retryAfter estimates how long until the bucket holds a token again.
+func (b *tokenBucket) retryAfter(limit RateLimit) time.Duration {
+	missing := 1 - b.tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing * float64(limit.Per) / float64(limit.Events))
+}
+
+// floodGuard is owned by the client's readPump goroutine and needs no locking.
+type floodGuard struct {
+	buckets     map[string]*tokenBucket
+	strikes     int
+	firstStrike time.Time
+	muted       bool // Already escalated to a temporary mute in this strike window
+}
+
+// admit reports whether a frame of the given message type may be handled.
+// When it returns false the frame has been dropped and the client warned;
+// disconnect tells the caller to stop reading from the connection.
+func (c *Client) admit(messageType string) (ok, disconnect bool) {
+	if c.flood == nil {
+		c.flood = &floodGuard{buckets: make(map[string]*tokenBucket)}
+	}
+	g := c.flood
+	h := c.hub
+	now := time.Now()
+
+	for _, class := range []string{rateClassFrames, rateClassOf(messageType)} {
+		limit, limited := h.rateLimits[class]
+		if class == "" || !limited || limit.Events == 0 {
+			continue
+		}
+		bucket, exists := g.buckets[class]
+		if !exists {
+			bucket = &tokenBucket{}
+			g.buckets[class] = bucket
+		}
+		if bucket.take(limit, now) {
+			continue
+		}
+		return false, g.strike(c, class, bucket.retryAfter(limit), now)
+	}
+	return true, false
+}
+
+// strike records a violation and escalates: warning, temporary mute, then disconnect.
+func (g *floodGuard) strike(c *Client, class string, retryAfter time.Duration, now time.Time) bool {
+	if now.Sub(g.firstStrike) > strikeWindow {
+		g.strikes, g.firstStrike, g.muted = 0, now, false
+	}
+	g.strikes++
+	h := c.hub
+	atomic.AddInt64(&h.metrics.rateLimited, 1)
+
+	switch {
+	case g.strikes >= strikesToKick:
+		log.Printf("Disconnecting %s (%s) for flooding", c.nickname, c.ip)
+		disconnectClient(c, "kicked", "发送过于频繁，连接已断开")
+		return true
+	case g.strikes >= strikesToMute && !g.muted:
+		g.muted = true
+		h.mutex.Lock()
+		if c.clientID != "" {
+			if until, ok := h.mutes[c.clientID]; !ok || (!until.IsZero() && until.Before(now.Add(floodMuteTimeout))) {
+				h.mutes[c.clientID] = now.Add(floodMuteTimeout)
+			}
+		}
+		h.mutex.Unlock()
+		log.Printf("Muting %s (%s) for %s after repeated flooding", c.nickname, c.ip, floodMuteTimeout)
+		sendRateLimited(c, class, floodMuteTimeout, "发送过于频繁，已被临时禁言")
+	case g.strikes == 1 || g.strikes%5 == 0:
+		// 警告本身也限量，避免回复把发送通道塞满
+		sendRateLimited(c, class, retryAfter, "发送过于频繁，请稍后再试")
+	}
+	return false
+}
+
+func sendRateLimited(c *Client, class string, retryAfter time.Duration, reason string) {
+	response := map[string]interface{}{"type": "rateLimited", "class": class, "retryAfter": retryAfter.Milliseconds(), "data": reason}
+	if msgBytes, err := json.Marshal(response); err == nil {
+		sendMessageToClient(c, msgBytes)
+	}
+}
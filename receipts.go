@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+// 私聊已读回执：记录每个会话中自己已读到的最后一条消息 ID，并转告对方
+
+type readWatermark struct {
+	Read     int64 `json:"read,omitempty"`     // Last message ID this user has read from the peer
+	PeerRead int64 `json:"peerRead,omitempty"` // Last message ID the peer has read from this user
+}
+
+// findSessionByNicknameLocked resolves a nickname to its session, live or not. Caller must hold mutex.
+func (h *Hub) findSessionByNicknameLocked(nickname string) *Session {
+	if c, ok := h.nicknames[nickname]; ok {
+		if session, ok := h.sessions[c.clientID]; ok {
+			return session
+		}
+	}
+	return h.findOfflineSessionLocked(nickname)
+}
+
+func (h *Hub) handleRead(client *Client, msg Message) {
+	if msg.ID <= 0 || msg.ID > atomic.LoadInt64(&h.lastMessageID) {
+		sendError(client, msg, errInvalidRequest, "消息 ID 无效")
+		return
+	}
+
+	h.mutex.Lock()
+	reader, ok := h.sessions[client.clientID]
+	peer := h.findSessionByNicknameLocked(msg.To)
+	h.mutex.Unlock()
+	if !ok || peer == nil || peer == reader {
+		sendError(client, msg, errNotFound, "用户不存在")
+		return
+	}
+	// 回执只能指向对方发给自己的私聊消息
+	route := h.lookupMessage(msg.ID)
+	if route == nil {
+		sendError(client, msg, errNotFound, "消息不存在")
+		return
+	}
+	if route.Kind != historyConvPrivate || route.SenderID != peer.ClientID || route.ToID != reader.ClientID {
+		sendError(client, msg, errInvalidRequest, "该消息不是对方发给你的私聊")
+		return
+	}
+
+	h.mutex.Lock()
+	if reader.ReadMarks == nil {
+		reader.ReadMarks = make(map[string]int64)
+	}
+	if msg.ID <= reader.ReadMarks[peer.ClientID] {
+		// 已读位置只会前进
+		h.mutex.Unlock()
+		return
+	}
+	reader.ReadMarks[peer.ClientID] = msg.ID
+	peerClient := peer.Client
+	nickname := reader.Nickname
+	h.mutex.Unlock()
+
+	if peerClient == nil {
+		return
+	}
+	response := Message{Type: "read", From: nickname, ID: msg.ID}
+	if msgBytes, err := json.Marshal(response); err == nil {
+		sendMessageToClient(peerClient, msgBytes)
+	}
+}
+
+// readWatermarksLocked collects both directions of read state for each of the
+// session's private conversations, keyed by the peer's current nickname. Caller must hold mutex.
+func (h *Hub) readWatermarksLocked(session *Session) map[string]readWatermark {
+	marks := make(map[string]readWatermark)
+	for peerID, id := range session.ReadMarks {
+		if peer, ok := h.sessions[peerID]; ok {
+			mark := marks[peer.Nickname]
+			mark.Read = id
+			marks[peer.Nickname] = mark
+		}
+	}
+	for _, peer := range h.sessions {
+		if id, ok := peer.ReadMarks[session.ClientID]; ok && peer != session {
+			mark := marks[peer.Nickname]
+			mark.PeerRead = id
+			marks[peer.Nickname] = mark
+		}
+	}
+	return marks
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const maxRoomNameLength = 32
+
+// Room 是与全局 "group" 并存的命名聊天室。
+// 成员按 ClientID 记录，因此断线重连后成员身份仍然保留。
+type Room struct {
+	Name      string
+	CreatedBy string // ClientID of the creator
+	CreatedAt time.Time
+	Members   map[string]bool // ClientID set
+}
+
+type roomSummary struct {
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+}
+
+// normalizeRoomName strips the surrounding whitespace clients may send with a
+// room name, so creating, joining and leaving all refer to the same room.
+func normalizeRoomName(name string) string {
+	return strings.TrimSpace(name)
+}
+
+func validRoomName(name string) bool {
+	name = normalizeRoomName(name)
+	return name != "" && name != groupRecipient && utf8.RuneCountInString(name) <= maxRoomNameLength
+}
+
+// sendRoomError rejects a request that names a room; legacy clients receive a roomError event.
+func sendRoomError(client *Client, request Message, code, reason string) {
+	rejectOperation(client, request, code, reason, map[string]string{"type": "roomError", "room": request.Room})
+}
+
+func (h *Hub) handleCreateRoom(client *Client, msg Message) {
+	name := normalizeRoomName(msg.Room)
+	if !validRoomName(name) {
+		sendRoomError(client, msg, errInvalidRequest, "房间名无效")
+		return
+	}
+	h.mutex.Lock()
+	if _, exists := h.rooms[name]; exists {
+		h.mutex.Unlock()
+		sendRoomError(client, msg, errConflict, "房间已存在")
+		return
+	}
+	h.rooms[name] = &Room{
+		Name:      name,
+		CreatedBy: client.clientID,
+		CreatedAt: time.Now(),
+		Members:   map[string]bool{client.clientID: true},
+	}
+	h.mutex.Unlock()
+	log.Printf("Room '%s' created by %s", name, client.nickname)
+
+	h.broadcastRoomPresence("roomJoined", name, client.nickname)
+	h.broadcastRoomMembers(name)
+	h.broadcastRoomList()
+}
+
+func (h *Hub) handleJoinRoom(client *Client, msg Message) {
+	name := normalizeRoomName(msg.Room)
+	h.mutex.Lock()
+	room, ok := h.rooms[name]
+	if !ok {
+		h.mutex.Unlock()
+		sendRoomError(client, msg, errNotFound, "房间不存在")
+		return
+	}
+	if room.Members[client.clientID] {
+		h.mutex.Unlock()
+		h.broadcastRoomMembers(name)
+		return
+	}
+	room.Members[client.clientID] = true
+	h.mutex.Unlock()
+	log.Printf("%s joined room '%s'", client.nickname, name)
+
+	h.broadcastRoomPresence("roomJoined", name, client.nickname)
+	h.broadcastRoomMembers(name)
+	h.broadcastRoomList()
+}
+
+func (h *Hub) handleLeaveRoom(client *Client, msg Message) {
+	name := normalizeRoomName(msg.Room)
+	h.mutex.Lock()
+	room, ok := h.rooms[name]
+	if !ok || !room.Members[client.clientID] {
+		h.mutex.Unlock()
+		sendRoomError(client, msg, errForbidden, "你不在该房间中")
+		return
+	}
+	// 在移除之前收集成员，这样离开者自己也能收到确认
+	recipients := h.roomClientsLocked(name)
+	delete(room.Members, client.clientID)
+	empty := len(room.Members) == 0
+	if empty {
+		delete(h.rooms, name)
+	}
+	h.mutex.Unlock()
+	log.Printf("%s left room '%s'", client.nickname, name)
+
+	response := map[string]string{"type": "roomLeft", "room": name, "nickname": client.nickname}
+	if msgBytes, err := json.Marshal(response); err == nil {
+		for _, c := range recipients {
+			sendMessageToClient(c, msgBytes)
+		}
+	}
+	if empty {
+		log.Printf("Room '%s' is empty. Removing it.", name)
+	} else {
+		h.broadcastRoomMembers(name)
+	}
+	h.broadcastRoomList()
+}
+
+// isRoomMember reports whether the client belongs to the named room.
+func (h *Hub) isRoomMember(name string, client *Client) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	room, ok := h.rooms[name]
+	return ok && room.Members[client.clientID]
+}
+
+// roomClientsLocked returns the connected members of a room. Caller must hold mutex.
+func (h *Hub) roomClientsLocked(name string) []*Client {
+	room, ok := h.rooms[name]
+	if !ok {
+		return nil
+	}
+	members := make([]*Client, 0, len(room.Members))
+	for clientID := range room.Members {
+		if session, ok := h.sessions[clientID]; ok && session.Client != nil {
+			members = append(members, session.Client)
+		}
+	}
+	return members
+}
+
+// roomsOfLocked returns the names of all rooms the ClientID belongs to. Caller must hold mutex.
+func (h *Hub) roomsOfLocked(clientID string) []string {
+	names := []string{}
+	for name, room := range h.rooms {
+		if room.Members[clientID] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (h *Hub) broadcastToRoom(name string, message []byte, exclude *Client) {
+	h.mutex.Lock()
+	members := h.roomClientsLocked(name)
+	h.mutex.Unlock()
+
+	for _, c := range members {
+		if c != exclude {
+			sendMessageToClient(c, message)
+		}
+	}
+}
+
+func (h *Hub) broadcastRoomPresence(eventType, name, nickname string) {
+	response := map[string]string{"type": eventType, "room": name, "nickname": nickname}
+	if msgBytes, err := json.Marshal(response); err == nil {
+		h.broadcastToRoom(name, msgBytes, nil)
+	}
+}
+
+// broadcastRoomMembers 向房间的在线成员发送成员列表（含公钥），
+// 这样客户端只需为真正的成员加密群组密钥。
+func (h *Hub) broadcastRoomMembers(name string) {
+	h.mutex.Lock()
+	members := h.roomClientsLocked(name)
+	userMap := make(map[string]string)
+	for _, c := range members {
+		userMap[c.nickname] = c.publicKey
+	}
+	h.mutex.Unlock()
+	if len(members) == 0 {
+		return
+	}
+
+	response := map[string]interface{}{"type": "roomMembers", "room": name, "users": userMap}
+	if msgBytes, err := json.Marshal(response); err == nil {
+		for _, c := range members {
+			sendMessageToClient(c, msgBytes)
+		}
+	}
+}
+
+func (h *Hub) broadcastAllRoomMembers() {
+	h.mutex.Lock()
+	names := make([]string, 0, len(h.rooms))
+	for name := range h.rooms {
+		names = append(names, name)
+	}
+	h.mutex.Unlock()
+
+	for _, name := range names {
+		h.broadcastRoomMembers(name)
+	}
+}
+
+func (h *Hub) roomListLocked() []roomSummary {
+	list := make([]roomSummary, 0, len(h.rooms))
+	for name, room := range h.rooms {
+		list = append(list, roomSummary{Name: name, Members: len(room.Members)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (h *Hub) sendRoomList(client *Client) {
+	h.mutex.Lock()
+	list := h.roomListLocked()
+	h.mutex.Unlock()
+	response := map[string]interface{}{"type": "roomList", "rooms": list}
+	if msgBytes, err := json.Marshal(response); err == nil {
+		sendMessageToClient(client, msgBytes)
+	}
+}
+
+func (h *Hub) broadcastRoomList() {
+	h.mutex.Lock()
+	list := h.roomListLocked()
+	h.mutex.Unlock()
+	response := map[string]interface{}{"type": "roomList", "rooms": list}
+	if msgBytes, err := json.Marshal(response); err == nil {
+		h.broadcastMessage(msgBytes, nil)
+	}
+}
+
+// removeSessionFromRoomsLocked drops an expired session from every room and
+// deletes rooms left empty. Caller must hold mutex. Returns the rooms that
+// still exist and whose member lists changed.
+func (h *Hub) removeSessionFromRoomsLocked(clientID string) (changed []string, removed bool) {
+	for name, room := range h.rooms {
+		if !room.Members[clientID] {
+			continue
+		}
+		delete(room.Members, clientID)
+		removed = true
+		if len(room.Members) == 0 {
+			log.Printf("Room '%s' is empty. Removing it.", name)
+			delete(h.rooms, name)
+		} else {
+			changed = append(changed, name)
+		}
+	}
+	return changed, removed
+}
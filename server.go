@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+)
+
+// Server 是一个完整的聊天服务器实例：一个 Hub 加上它的 HTTP 路由，可直接交给 http.Server 或 httptest。
+type Server struct {
+	hub     *Hub
+	handler http.Handler
+}
+
+// NewServer builds a server from cfg, restores the persisted state if enabled and starts
+// the background tasks. Call Close when the server is no longer needed.
+func NewServer(cfg Config) (*Server, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	store, err := newHistoryStore(cfg.History, cfg.HistorySize, cfg.HistoryFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialise message history: %w", err)
+	}
+	h := newHub(cfg, store)
+	if cfg.Persist {
+		if err := h.loadState(cfg.StateFile); err != nil {
+			h.Close()
+			return nil, fmt.Errorf("could not restore state: %w", err)
+		}
+	}
+	// 确保 uploads 目录存在，并启动后台清理任务
+	if err := h.start(); err != nil {
+		h.Close()
+		return nil, fmt.Errorf("could not prepare uploads directory: %w", err)
+	}
+	return &Server{hub: h, handler: h.routes(cfg.StaticDir)}, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Close stops the background tasks and closes the history store.
+func (s *Server) Close() {
+	s.hub.Close()
+}
+
+// routes registers every HTTP endpoint of the hub.
+func (h *Hub) routes(staticDir string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(staticDir))))
+	mux.HandleFunc("/ws", h.handleConnections)
+	mux.HandleFunc("/metrics", h.handleMetrics)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", h.handleReadyz)
+	mux.HandleFunc("/admin", h.withAdmin(h.handleAdminStatus))
+
+	// 上传与下载均需携带 websocket 注册后下发的会话令牌
+	mux.HandleFunc("/upload/start", h.withSession(h.handleUploadStart))
+	mux.HandleFunc("/upload/chunk", h.withSession(h.handleUploadChunk))
+	mux.HandleFunc("/upload/finish", h.withSession(h.handleUploadFinish))
+	mux.HandleFunc("/upload/status", h.withSession(h.handleUploadStatus))
+
+	mux.HandleFunc("/download/", h.withSession(h.handleFileDownload))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join(staticDir, "index.html"))
+	})
+	return mux
+}
@@ -0,0 +1,752 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"chatroom/internal/testclient"
+)
+
+// startServer runs an in-process server on a temporary uploads directory.
+func startServer(t *testing.T, configure func(*Config)) (*Server, *httptest.Server) {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.UploadsDir = t.TempDir()
+	if configure != nil {
+		configure(&cfg)
+	}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	ts := httptest.NewServer(srv)
+	t.Cleanup(func() {
+		ts.Close()
+		srv.Close()
+	})
+	return srv, ts
+}
+
+func newIdentity(t *testing.T, clientID string) *testclient.Identity {
+	t.Helper()
+	id, err := testclient.NewIdentity(clientID)
+	if err != nil {
+		t.Fatalf("NewIdentity: %v", err)
+	}
+	return id
+}
+
+// connect registers a client and closes it when the test ends.
+func connect(t *testing.T, ts *httptest.Server, id *testclient.Identity, nickname string) *testclient.Client {
+	t.Helper()
+	c, _, err := testclient.Connect(ts.URL, id, nickname)
+	if err != nil {
+		t.Fatalf("connect %s: %v", id.ClientID, err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func expect(t *testing.T, c *testclient.Client, types ...string) testclient.Event {
+	t.Helper()
+	e, err := c.Expect(types...)
+	if err != nil {
+		t.Fatalf("%s: %v", c.Nickname, err)
+	}
+	return e
+}
+
+// waitFor polls cond until it holds or a few seconds have passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRegisterAndRelay(t *testing.T) {
+	_, ts := startServer(t, nil)
+	alice := connect(t, ts, newIdentity(t, "alice-id"), "alice")
+	bob := connect(t, ts, newIdentity(t, "bob-id"), "bob")
+
+	if err := alice.PrivateMessage("bob", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	msg := expect(t, bob, "privateMessage")
+	if msg.String("from") != "alice" || msg.String("data") != "secret" || msg.Int("id") == 0 {
+		t.Errorf("unexpected privateMessage: %s", msg.Raw)
+	}
+	status := expect(t, alice, "messageStatus")
+	if status.String("status") != deliveryDelivered || status.Int("id") != msg.Int("id") {
+		t.Errorf("unexpected messageStatus: %s", status.Raw)
+	}
+
+	if err := bob.GroupMessage("", "hello all"); err != nil {
+		t.Fatal(err)
+	}
+	if group := expect(t, alice, "groupMessage"); group.String("from") != "bob" || group.String("data") != "hello all" {
+		t.Errorf("unexpected groupMessage: %s", group.Raw)
+	}
+}
+
+func TestReconnectResumesSession(t *testing.T) {
+	_, ts := startServer(t, nil)
+	id := newIdentity(t, "alice-id")
+	alice, _, err := testclient.Connect(ts.URL, id, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob := connect(t, ts, newIdentity(t, "bob-id"), "bob")
+
+	alice.Close()
+	expect(t, bob, "userLeft")
+
+	// 离线期间的私聊进入信箱，重连后投递
+	if err := bob.PrivateMessage("alice", "while you were away"); err != nil {
+		t.Fatal(err)
+	}
+	if status := expect(t, bob, "messageStatus"); status.String("status") != deliveryQueued {
+		t.Fatalf("expected the message to be queued, got %s", status.Raw)
+	}
+
+	alice, welcome, err := testclient.Connect(ts.URL, id, "someone-else")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(alice.Close)
+	if welcome.String("nickname") != "alice" {
+		t.Errorf("reconnected as %q, want the session's nickname alice", welcome.String("nickname"))
+	}
+	if msg := expect(t, alice, "privateMessage"); msg.String("data") != "while you were away" {
+		t.Errorf("unexpected queued message: %s", msg.Raw)
+	}
+	if delivered := expect(t, bob, "delivered"); delivered.String("to") != "alice" {
+		t.Errorf("unexpected delivered event: %s", delivered.Raw)
+	}
+}
+
+func TestDormantSessionExpires(t *testing.T) {
+	srv, ts := startServer(t, func(c *Config) { c.SessionTimeout = Duration(200 * time.Millisecond) })
+	alice, _, err := testclient.Connect(ts.URL, newIdentity(t, "alice-id"), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob := connect(t, ts, newIdentity(t, "bob-id"), "bob")
+
+	alice.Close()
+	expect(t, bob, "userLeft")
+	// 清理间隔随会话超时缩短，过期的会话很快被移除
+	waitFor(t, "the dormant session to be removed", func() bool {
+		srv.hub.mutex.Lock()
+		defer srv.hub.mutex.Unlock()
+		_, ok := srv.hub.sessions["alice-id"]
+		return !ok
+	})
+	if err := bob.PrivateMessage("alice", "anyone there?"); err != nil {
+		t.Fatal(err)
+	}
+	if status := expect(t, bob, "messageStatus"); status.String("status") != deliveryFailed {
+		t.Errorf("expected delivery to an expired session to fail, got %s", status.Raw)
+	}
+}
+
+func TestNicknameCollision(t *testing.T) {
+	_, ts := startServer(t, nil)
+	connect(t, ts, newIdentity(t, "first"), "alice")
+	second := connect(t, ts, newIdentity(t, "second"), "alice")
+	if second.Nickname == "alice" || second.Nickname == "" {
+		t.Fatalf("second client got nickname %q, want a generated one", second.Nickname)
+	}
+
+	if err := second.Send(Message{Type: "changeNickname", Data: "alice", RequestID: "rename"}); err != nil {
+		t.Fatal(err)
+	}
+	e := expect(t, second, "error", "nicknameChanged")
+	if e.Type != "error" || e.String("code") != errConflict || e.String("requestId") != "rename" {
+		t.Errorf("expected a conflict error, got %s", e.Raw)
+	}
+}
+
+func TestReadReceipts(t *testing.T) {
+	_, ts := startServer(t, nil)
+	alice := connect(t, ts, newIdentity(t, "alice-id"), "alice")
+	bob := connect(t, ts, newIdentity(t, "bob-id"), "bob")
+
+	if err := alice.GroupMessage("", "hello everyone"); err != nil {
+		t.Fatal(err)
+	}
+	group := expect(t, bob, "groupMessage").Int("id")
+	if err := alice.PrivateMessage("bob", "hello bob"); err != nil {
+		t.Fatal(err)
+	}
+	private := expect(t, bob, "privateMessage").Int("id")
+
+	// 群聊消息和自己发出的消息都不能当作对方的私聊来回执
+	for _, id := range []int64{group, private} {
+		if err := alice.Send(Message{Type: "read", To: "bob", ID: id}); err != nil {
+			t.Fatal(err)
+		}
+		if e := expect(t, alice, "error"); e.String("code") != errInvalidRequest {
+			t.Errorf("read of message %d: expected an invalidRequest error, got %s", id, e.Raw)
+		}
+	}
+
+	if err := bob.Send(Message{Type: "read", To: "alice", ID: private}); err != nil {
+		t.Fatal(err)
+	}
+	if read := expect(t, alice, "read"); read.String("from") != "bob" || read.Int("id") != private {
+		t.Errorf("unexpected read receipt: %s", read.Raw)
+	}
+}
+
+func TestRejectedRequestsGetErrors(t *testing.T) {
+	_, ts := startServer(t, nil)
+	alice := connect(t, ts, newIdentity(t, "alice-id"), "alice")
+
+	for _, c := range []struct {
+		msg  Message
+		code string
+	}{
+		{Message{Type: "register", ClientID: "alice-id", ProposedNickname: "again"}, errInvalidRequest},
+		{Message{Type: "challengeResponse", Data: "nonce"}, errInvalidRequest},
+		{Message{Type: "fileShare", To: "group"}, errInvalidRequest},
+		{Message{Type: "read", To: "nobody", ID: 1}, errInvalidRequest},
+		{Message{Type: "ack", ID: 1}, errNotFound},
+		{Message{Type: "typingStart", To: "nobody"}, errNotFound},
+		{Message{Type: "typingStart", Room: "nowhere"}, errForbidden},
+	} {
+		c.msg.RequestID = c.msg.Type
+		if err := alice.Send(c.msg); err != nil {
+			t.Fatal(err)
+		}
+		if e := expect(t, alice, "error"); e.String("code") != c.code || e.String("requestId") != c.msg.Type {
+			t.Errorf("%s: expected a %s error, got %s", c.msg.Type, c.code, e.Raw)
+		}
+	}
+}
+
+func TestFailedLookupsGetErrors(t *testing.T) {
+	srv, ts := startServer(t, func(cfg *Config) {
+		cfg.History, cfg.HistoryFile, cfg.HistorySize = "file", filepath.Join(t.TempDir(), "history.log"), 1
+	})
+	alice := connect(t, ts, newIdentity(t, "alice-id"), "alice")
+	bob := connect(t, ts, newIdentity(t, "bob-id"), "bob")
+
+	if err := alice.PrivateMessage("bob", "first"); err != nil {
+		t.Fatal(err)
+	}
+	root := expect(t, bob, "privateMessage").Int("id")
+	if err := alice.Send(Message{Type: "privateMessage", To: "bob", Data: "second", ReplyTo: root}); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, bob, "privateMessage")
+
+	// 发送者不能替接收者确认
+	if err := alice.Send(Message{Type: "ack", ID: root, RequestID: "self-ack"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := expect(t, alice, "error"); e.String("code") != errInvalidRequest || e.String("requestId") != "self-ack" {
+		t.Errorf("expected an invalidRequest error, got %s", e.Raw)
+	}
+
+	// 只缓存了一条记录，更早的需要从已关闭的日志中读取
+	srv.hub.history.Close()
+	for _, req := range []Message{
+		{Type: "historyRequest", To: "alice", RequestID: "history"},
+		{Type: "threadRequest", ThreadID: root, RequestID: "thread"},
+	} {
+		if err := bob.Send(req); err != nil {
+			t.Fatal(err)
+		}
+		if e := expect(t, bob, "error"); e.String("code") != errInternal || e.String("requestId") != req.RequestID {
+			t.Errorf("%s: expected an internal error, got %s", req.Type, e.Raw)
+		}
+	}
+}
+
+func TestHijackRejected(t *testing.T) {
+	_, ts := startServer(t, nil)
+	owner := connect(t, ts, newIdentity(t, "shared-id"), "owner")
+
+	intruder, err := testclient.Dial(ts.URL, newIdentity(t, "shared-id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(intruder.Close)
+	if _, err := intruder.Register("intruder"); err == nil {
+		t.Fatal("registration with another key for the same ClientID succeeded")
+	}
+	select {
+	case <-intruder.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not close the rejected connection")
+	}
+
+	// 原会话不受影响
+	if err := owner.GroupMessage("", "still here"); err != nil {
+		t.Fatal(err)
+	}
+	if status := expect(t, owner, "messageStatus"); status.String("status") != deliverySent {
+		t.Errorf("owner's session was disturbed: %s", status.Raw)
+	}
+}
+
+func TestFileReferenceCleanup(t *testing.T) {
+	srv, ts := startServer(t, nil)
+	alice, _, err := testclient.Connect(ts.URL, newIdentity(t, "alice-id"), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob := connect(t, ts, newIdentity(t, "bob-id"), "bob")
+
+	content := bytes.Repeat([]byte("encrypted blob "), 1000)
+	uuid, err := alice.Upload(content, 4096)
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if err := alice.FileShare("bob", uuid, "encrypted metadata"); err != nil {
+		t.Fatal(err)
+	}
+	if share := expect(t, bob, "fileShare"); share.String("uuid") != uuid {
+		t.Fatalf("unexpected fileShare: %s", share.Raw)
+	}
+
+	status, body, err := bob.Download(uuid)
+	if err != nil || status != http.StatusOK || !bytes.Equal(body, content) {
+		t.Fatalf("download before cleanup: status %d, %d bytes, err %v", status, len(body), err)
+	}
+
+	// 发送者断开后文件的唯一引用被释放，磁盘上的文件随之删除
+	alice.Close()
+	path := filepath.Join(srv.hub.uploadsDir, uuid)
+	waitFor(t, "the shared file to be deleted", func() bool {
+		_, err := os.Stat(path)
+		return os.IsNotExist(err)
+	})
+	if status, _, err := bob.Download(uuid); err != nil || status != http.StatusNotFound {
+		t.Errorf("download after cleanup: status %d, err %v, want 404", status, err)
+	}
+}
+
+func TestGroupNicknameGrantsNothing(t *testing.T) {
+	srv, ts := startServer(t, nil)
+	alice := connect(t, ts, newIdentity(t, "alice-id"), "alice")
+	mallory := connect(t, ts, newIdentity(t, "mallory-id"), "mallory")
+	eve := connect(t, ts, newIdentity(t, "eve-id"), "group")
+	if eve.Nickname == "group" {
+		t.Fatal("registered with the reserved nickname group")
+	}
+
+	uuid, err := alice.Upload([]byte("encrypted blob"), 4096)
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if err := alice.FileShare("mallory", uuid, "encrypted metadata"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, mallory, "fileShare")
+
+	if err := mallory.Send(Message{Type: "changeNickname", Data: "group"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := expect(t, mallory, "error"); e.String("code") != errInvalidRequest {
+		t.Errorf("expected an invalidRequest error, got %s", e.Raw)
+	}
+	// 即使引用上显示的接收者昵称是 "group"，也不会变成群聊分享
+	srv.hub.filesMu.Lock()
+	srv.hub.fileRegistry[uuid].References[0].Recipient = groupRecipient
+	srv.hub.filesMu.Unlock()
+	if status, _, err := eve.Download(uuid); err != nil || status != http.StatusForbidden {
+		t.Errorf("download by a bystander: status %d, err %v, want 403", status, err)
+	}
+}
+
+func TestLimitedDownloadCanResume(t *testing.T) {
+	srv, ts := startServer(t, nil)
+	alice := connect(t, ts, newIdentity(t, "alice-id"), "alice")
+	bob := connect(t, ts, newIdentity(t, "bob-id"), "bob")
+	carol := connect(t, ts, newIdentity(t, "carol-id"), "carol")
+
+	content := bytes.Repeat([]byte("encrypted blob "), 1000)
+	uuid, err := alice.Upload(content, 4096)
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if err := alice.Send(Message{Type: "fileShare", To: "group", UUID: uuid, Data: "encrypted metadata", MaxDownloads: 1}); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, bob, "fileShare")
+	expect(t, carol, "fileShare")
+
+	if status, body, err := bob.Download(uuid); err != nil || status != http.StatusOK || !bytes.Equal(body, content) {
+		t.Fatalf("first download: status %d, %d bytes, err %v", status, len(body), err)
+	}
+	// 同一下载者的续传不再计数
+	offset := int64(len(content) / 2)
+	if status, body, err := bob.DownloadFrom(uuid, offset); err != nil || status != http.StatusPartialContent || !bytes.Equal(body, content[offset:]) {
+		t.Errorf("resumed download: status %d, %d bytes, err %v", status, len(body), err)
+	}
+	if status, _, err := carol.Download(uuid); err != nil || status != http.StatusGone {
+		t.Errorf("download past the limit: status %d, err %v, want 410", status, err)
+	}
+
+	// 续传窗口过后文件被删除
+	srv.hub.expireFiles(time.Now().Add(fileResumeWindow + time.Minute))
+	if e := expect(t, bob, "fileExpired"); e.String("uuid") != uuid {
+		t.Errorf("unexpected fileExpired: %s", e.Raw)
+	}
+	if status, _, err := bob.DownloadFrom(uuid, offset); err != nil || status != http.StatusGone {
+		t.Errorf("resume after the window: status %d, err %v, want 410", status, err)
+	}
+}
+
+func TestFileShareToOfflineNickname(t *testing.T) {
+	_, ts := startServer(t, nil)
+	alice := connect(t, ts, newIdentity(t, "alice-id"), "alice")
+
+	uuid, err := alice.Upload([]byte("encrypted blob"), 4096)
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if err := alice.FileShare("carol", uuid, "encrypted metadata"); err != nil {
+		t.Fatal(err)
+	}
+	if status := expect(t, alice, "messageStatus"); status.String("status") != deliveryFailed {
+		t.Fatalf("unexpected messageStatus: %s", status.Raw)
+	}
+
+	// 投递失败不登记引用，之后注册成 carol 的人不能借昵称取得下载权限
+	mallory := connect(t, ts, newIdentity(t, "mallory-id"), "carol")
+	if status, _, err := mallory.Download(uuid); err != nil || status != http.StatusNotFound {
+		t.Errorf("download by a later carol: status %d, err %v, want 404", status, err)
+	}
+}
+
+func TestRestoredFilesFollowClientID(t *testing.T) {
+	dir := t.TempDir()
+	persist := func(cfg *Config) {
+		cfg.Persist, cfg.StateFile, cfg.UploadsDir = true, filepath.Join(dir, "state.json"), filepath.Join(dir, "uploads")
+	}
+	srv, ts := startServer(t, persist)
+	alice := connect(t, ts, newIdentity(t, "alice-id"), "alice")
+	bobID := newIdentity(t, "bob-id")
+	bob := connect(t, ts, bobID, "bob")
+
+	uuid, err := alice.Upload([]byte("encrypted blob"), 4096)
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if err := alice.FileShare("bob", uuid, "encrypted metadata"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, bob, "fileShare")
+	if err := srv.hub.saveState(filepath.Join(dir, "state.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后所有会话都离线，先注册 bob 这个昵称的人也拿不到 Bob 的文件
+	_, restarted := startServer(t, persist)
+	mallory := connect(t, restarted, newIdentity(t, "mallory-id"), "bob")
+	if status, _, err := mallory.Download(uuid); err != nil || status != http.StatusForbidden {
+		t.Errorf("download by a new bob: status %d, err %v, want 403", status, err)
+	}
+	mallory.Close()
+
+	bob = connect(t, restarted, bobID, "bob")
+	if status, _, err := bob.Download(uuid); err != nil || status != http.StatusOK {
+		t.Errorf("download by the restored bob: status %d, err %v, want 200", status, err)
+	}
+}
+
+func TestEditAndDelete(t *testing.T) {
+	historyFile := filepath.Join(t.TempDir(), "history.log")
+	_, ts := startServer(t, func(cfg *Config) {
+		cfg.History, cfg.HistoryFile = "file", historyFile
+	})
+	alice := connect(t, ts, newIdentity(t, "alice-id"), "alice")
+	bob := connect(t, ts, newIdentity(t, "bob-id"), "bob")
+
+	if err := alice.PrivateMessage("bob", "original"); err != nil {
+		t.Fatal(err)
+	}
+	id := expect(t, bob, "privateMessage").Int("id")
+
+	if err := alice.Send(Message{Type: "editMessage", ID: id, Data: "corrected"}); err != nil {
+		t.Fatal(err)
+	}
+	if edited := expect(t, bob, "messageEdited"); edited.Int("id") != id || edited.String("data") != "corrected" || edited.String("from") != "alice" {
+		t.Errorf("unexpected messageEdited: %s", edited.Raw)
+	}
+	expect(t, alice, "messageEdited")
+
+	// 只有原发送者可以撤回
+	if err := bob.Send(Message{Type: "deleteMessage", ID: id, RequestID: "steal"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := expect(t, bob, "error"); e.String("code") != errForbidden || e.String("requestId") != "steal" {
+		t.Errorf("expected a forbidden error, got %s", e.Raw)
+	}
+
+	if err := alice.Send(Message{Type: "deleteMessage", ID: id}); err != nil {
+		t.Fatal(err)
+	}
+	if deleted := expect(t, bob, "messageDeleted"); deleted.Int("id") != id || deleted.String("data") != "" {
+		t.Errorf("unexpected messageDeleted: %s", deleted.Raw)
+	}
+
+	if err := bob.Send(Message{Type: "historyRequest", To: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	var history struct {
+		Messages []Message `json:"messages"`
+	}
+	if err := expect(t, bob, "history").Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Messages) != 1 || !history.Messages[0].Deleted || history.Messages[0].Data != "" {
+		t.Errorf("history should hold a tombstone, got %+v", history.Messages)
+	}
+
+	// 重放日志时后写入的记录覆盖先前的
+	reopened, err := OpenFileHistory(historyFile, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	entries, _, _ := reopened.Query(HistoryQuery{})
+	if len(entries) != 1 || !entries[0].Message.Deleted || reopened.LastID() != id {
+		t.Errorf("replayed history = %+v, last ID %d", entries, reopened.LastID())
+	}
+}
+
+func TestHistoryOutOfOrder(t *testing.T) {
+	historyFile := filepath.Join(t.TempDir(), "history.log")
+	file, err := OpenFileHistory(historyFile, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]HistoryStore{"memory": NewMemoryHistory(10), "file": file}
+
+	// 消息 ID 先于写入历史分配，两个发送者的记录可能交错到达
+	entry := func(id int64, data string) *HistoryEntry {
+		return &HistoryEntry{Kind: historyConvGroup, FromID: "alice-id", Message: Message{Type: "groupMessage", ID: id, Data: data}}
+	}
+	for name, store := range stores {
+		for _, id := range []int64{2, 1, 3} {
+			if err := store.Append(entry(id, "original")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Update(entry(1, "edited")); err != nil {
+			t.Fatal(err)
+		}
+		entries, _, _ := store.Query(HistoryQuery{})
+		if len(entries) != 3 || entries[0].Message.ID != 1 || entries[0].Message.Data != "edited" || entries[2].Message.ID != 3 {
+			t.Errorf("%s history = %+v", name, entries)
+		}
+		if page, more, _ := store.Query(HistoryQuery{Before: 3, Limit: 1}); len(page) != 1 || page[0].Message.ID != 2 || !more {
+			t.Errorf("%s page before 3 = %+v, more %v", name, page, more)
+		}
+		if e, err := store.Get(1); err != nil || e == nil || e.Message.Data != "edited" {
+			t.Errorf("%s Get(1) = %+v, %v", name, e, err)
+		}
+		if e, err := store.Get(4); err != nil || e != nil {
+			t.Errorf("%s Get(4) = %+v, %v, want nothing", name, e, err)
+		}
+	}
+	file.Close()
+
+	reopened, err := OpenFileHistory(historyFile, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Update(entry(2, "edited")); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Close()
+	if reopened, err = OpenFileHistory(historyFile, 10); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	entries, _, _ := reopened.Query(HistoryQuery{})
+	if len(entries) != 3 || entries[0].Message.Data != "edited" || entries[1].Message.Data != "edited" || reopened.LastID() != 3 {
+		t.Errorf("replayed history = %+v, last ID %d", entries, reopened.LastID())
+	}
+}
+
+func TestFileHistoryCompaction(t *testing.T) {
+	historyFile := filepath.Join(t.TempDir(), "history.log")
+	store, err := OpenFileHistory(historyFile, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := func(id int64, data string) *HistoryEntry {
+		return &HistoryEntry{Kind: historyConvGroup, FromID: "alice-id", Message: Message{Type: "groupMessage", ID: id, Data: data}}
+	}
+	for id := int64(1); id <= 5; id++ {
+		if err := store.Append(entry(id, "original")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 消息 1 已不在内存中，编辑只写入日志
+	if err := store.Update(entry(1, "edited")); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _, _ := store.Query(HistoryQuery{Before: 3}); len(entries) != 2 || entries[0].Message.Data != "edited" {
+		t.Errorf("paged history = %+v", entries)
+	}
+	if e, err := store.Get(1); err != nil || e == nil || e.Message.Data != "edited" {
+		t.Errorf("Get(1) from disk = %+v, %v", e, err)
+	}
+	store.Close()
+
+	countLines := func() int {
+		data, err := os.ReadFile(historyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Count(data, []byte("\n"))
+	}
+	if n := countLines(); n != 6 {
+		t.Fatalf("log has %d records before compaction, want 6", n)
+	}
+	if store, err = OpenFileHistory(historyFile, 2); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if n := countLines(); n != 5 {
+		t.Errorf("log has %d records after compaction, want 5", n)
+	}
+	entries, _, _ := store.Query(HistoryQuery{})
+	if len(entries) != 5 || entries[0].Message.Data != "edited" || store.LastID() != 5 {
+		t.Errorf("compacted history = %+v, last ID %d", entries, store.LastID())
+	}
+}
+
+func TestRoomNamesAreTrimmed(t *testing.T) {
+	_, ts := startServer(t, nil)
+	alice := connect(t, ts, newIdentity(t, "alice-id"), "alice")
+	bob := connect(t, ts, newIdentity(t, "bob-id"), "bob")
+
+	if err := alice.Send(Message{Type: "createRoom", Room: " dev "}); err != nil {
+		t.Fatal(err)
+	}
+	if e := expect(t, alice, "roomJoined", "error"); e.Type != "roomJoined" || e.String("room") != "dev" {
+		t.Fatalf("unexpected reply to createRoom: %s", e.Raw)
+	}
+
+	// 加入和离开时同样忽略首尾空白
+	if err := bob.Send(Message{Type: "joinRoom", Room: "dev  "}); err != nil {
+		t.Fatal(err)
+	}
+	if e := expect(t, bob, "roomJoined", "error"); e.Type != "roomJoined" || e.String("room") != "dev" {
+		t.Fatalf("unexpected reply to joinRoom: %s", e.Raw)
+	}
+	if err := bob.Send(Message{Type: "leaveRoom", Room: "\tdev"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := expect(t, bob, "roomLeft", "error"); e.Type != "roomLeft" || e.String("room") != "dev" {
+		t.Errorf("unexpected reply to leaveRoom: %s", e.Raw)
+	}
+}
+
+func TestReplyThreads(t *testing.T) {
+	_, ts := startServer(t, func(cfg *Config) { cfg.History = "memory" })
+	alice := connect(t, ts, newIdentity(t, "alice-id"), "alice")
+	bob := connect(t, ts, newIdentity(t, "bob-id"), "bob")
+
+	if err := alice.GroupMessage("", "which release?"); err != nil {
+		t.Fatal(err)
+	}
+	root := expect(t, bob, "groupMessage").Int("id")
+
+	if err := bob.Send(Message{Type: "groupMessage", Data: "the next one", ReplyTo: root}); err != nil {
+		t.Fatal(err)
+	}
+	reply := expect(t, alice, "groupMessage")
+	if reply.Int("replyTo") != root || reply.Int("threadID") != root {
+		t.Errorf("unexpected reply: %s", reply.Raw)
+	}
+	if update := expect(t, alice, "threadUpdate"); update.Int("threadID") != root || update.Int("replies") != 1 {
+		t.Errorf("unexpected threadUpdate: %s", update.Raw)
+	}
+
+	// 回复一条回复仍归入同一话题
+	if err := alice.Send(Message{Type: "groupMessage", Data: "agreed", ReplyTo: reply.Int("id")}); err != nil {
+		t.Fatal(err)
+	}
+	if nested := expect(t, bob, "groupMessage"); nested.Int("threadID") != root {
+		t.Errorf("reply to a reply left the thread: %s", nested.Raw)
+	}
+	if update := expect(t, bob, "threadUpdate"); update.Int("replies") != 2 {
+		t.Errorf("unexpected threadUpdate: %s", update.Raw)
+	}
+
+	// 不能在私聊中引用群聊消息
+	if err := bob.Send(Message{Type: "privateMessage", To: "alice", Data: "psst", ReplyTo: root, RequestID: "cross"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := expect(t, bob, "error"); e.String("code") != errInvalidRequest || e.String("requestId") != "cross" {
+		t.Errorf("expected an invalidRequest error, got %s", e.Raw)
+	}
+
+	if err := bob.Send(Message{Type: "threadRequest", ThreadID: root}); err != nil {
+		t.Fatal(err)
+	}
+	var thread struct {
+		Messages []Message `json:"messages"`
+	}
+	if err := expect(t, bob, "thread").Decode(&thread); err != nil {
+		t.Fatal(err)
+	}
+	if len(thread.Messages) != 3 || thread.Messages[0].ID != root {
+		t.Errorf("thread = %+v, want the root and two replies", thread.Messages)
+	}
+
+	// 撤回最后一条回复后回复数减一，最后回复退回到上一条
+	if err := alice.Send(Message{Type: "deleteMessage", ID: thread.Messages[2].ID}); err != nil {
+		t.Fatal(err)
+	}
+	if update := expect(t, bob, "threadUpdate"); update.Int("replies") != 1 || update.Int("lastReplyID") != reply.Int("id") {
+		t.Errorf("unexpected threadUpdate after deletion: %s", update.Raw)
+	}
+}
+
+func TestSelfSignedCAKeptWhenHalfMissing(t *testing.T) {
+	dir := t.TempDir()
+	if _, _, err := ensureSelfSigned(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	caCert, caKey, _, _ := selfSignedFiles(dir)
+	original, err := os.ReadFile(caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 私钥丢失时不能悄悄换一个新的 CA
+	if err := os.Remove(caKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ensureSelfSigned(dir, nil); err == nil {
+		t.Fatal("a CA certificate without its key was replaced instead of reported")
+	}
+	if current, err := os.ReadFile(caCert); err != nil || !bytes.Equal(current, original) {
+		t.Errorf("CA certificate was changed (err %v)", err)
+	}
+
+	if err := os.Remove(caCert); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ensureSelfSigned(dir, nil); err != nil {
+		t.Errorf("a fresh CA was not created once both files were gone: %v", err)
+	}
+}
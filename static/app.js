@@ -16,6 +16,7 @@ document.addEventListener("DOMContentLoaded", () => {
 
     let ws;
     let myNickname = "";
+    let sessionToken = ""; // 上传/下载接口需要的会话令牌，每次注册成功后更新
     let users = {};
     let selectedTarget = null;
 
@@ -227,6 +228,42 @@ document.addEventListener("DOMContentLoaded", () => {
         // 不再显示 "所有文件上传任务已处理完毕。"
     }
 
+    // --- 新增：按偏移量上传单个分片，失败时重试；返回服务器已确认的字节数 ---
+    async function uploadChunk(uuid, offset, bytes) {
+        const chunkHash = sha256(bytes);
+        for (let attempt = 1; ; attempt++) {
+            try {
+                const response = await fetch(
+                    `/upload/chunk?uuid=${uuid}&offset=${offset}`,
+                    {
+                        method: "POST",
+                        headers: {
+                            "Content-Type": "application/octet-stream",
+                            "X-Session-Token": sessionToken,
+                            "X-Chunk-SHA256": chunkHash
+                        },
+                        body: new Blob([bytes])
+                    }
+                );
+                const result = await response.json();
+                if (response.ok) return result.committed;
+                // 上一次请求其实已写入成功（只是响应丢失），直接继续
+                if (
+                    response.status === 409 &&
+                    result.committed === offset + bytes.length
+                ) {
+                    return result.committed;
+                }
+                throw new Error(result.error || "分片上传失败。");
+            } catch (error) {
+                if (attempt >= 3) throw error;
+                await new Promise(resolve =>
+                    setTimeout(resolve, 1000 * attempt)
+                );
+            }
+        }
+    }
+
     // --- REPLACED: uploadFile now encrypts all file metadata ---
     async function uploadFile(file, progressIndicator) {
         if (!file || !progressIndicator) return;
@@ -237,9 +274,18 @@ document.addEventListener("DOMContentLoaded", () => {
         try {
             progressIndicator.textElement.textContent = `[正在初始化上传...] "${file.name}"`;
             const startResponse = await fetch("/upload/start", {
-                method: "POST"
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/json",
+                    "X-Session-Token": sessionToken
+                },
+                // AES-CTR 不改变长度，明文大小即上传大小，便于服务器提前检查配额
+                body: JSON.stringify({ size: file.size })
             });
-            if (!startResponse.ok) throw new Error("无法初始化上传。");
+            if (!startResponse.ok) {
+                const startError = await startResponse.json().catch(() => ({}));
+                throw new Error(startError.error || "无法初始化上传。");
+            }
             const startResult = await startResponse.json();
             uuid = startResult.uuid;
 
@@ -259,27 +305,26 @@ document.addEventListener("DOMContentLoaded", () => {
                 }
             );
 
-            // Upload loop (unchanged)
+            // Upload loop: every chunk carries the offset of the encrypted stream
+            let offset = 0;
             for (let start = 0; start < file.size; start += CHUNK_SIZE) {
                 const chunk = file.slice(start, start + CHUNK_SIZE);
                 const chunkBuffer = await chunk.arrayBuffer();
                 const wordArray = CryptoJS.lib.WordArray.create(chunkBuffer);
                 const encryptedChunk = cipher.process(wordArray);
-                const encryptedBlob = new Blob([
-                    wordArrayToUint8Array(encryptedChunk)
-                ]);
-                const chunkResponse = await fetch(
-                    `/upload/chunk?uuid=${uuid}`,
-                    {
-                        method: "POST",
-                        headers: { "Content-Type": "application/octet-stream" },
-                        body: encryptedBlob
+                if (encryptedChunk.sigBytes > 0) {
+                    try {
+                        offset = await uploadChunk(
+                            uuid,
+                            offset,
+                            wordArrayToUint8Array(encryptedChunk)
+                        );
+                    } catch (error) {
+                        throw new Error(
+                            `分片 ${start / CHUNK_SIZE + 1} 上传失败: ${error.message}`
+                        );
                     }
-                );
-                if (!chunkResponse.ok)
-                    throw new Error(
-                        `分片 ${start / CHUNK_SIZE + 1} 上传失败。`
-                    );
+                }
                 const progress = Math.round(
                     ((start + chunk.size) / file.size) * 100
                 );
@@ -288,16 +333,19 @@ document.addEventListener("DOMContentLoaded", () => {
             }
             const finalEncrypted = cipher.finalize();
             if (finalEncrypted.sigBytes > 0) {
-                await fetch(`/upload/chunk?uuid=${uuid}`, {
-                    method: "POST",
-                    headers: { "Content-Type": "application/octet-stream" },
-                    body: new Blob([wordArrayToUint8Array(finalEncrypted)])
-                });
+                offset = await uploadChunk(
+                    uuid,
+                    offset,
+                    wordArrayToUint8Array(finalEncrypted)
+                );
             }
             const finishResponse = await fetch("/upload/finish", {
                 method: "POST",
-                headers: { "Content-Type": "application/json" },
-                body: JSON.stringify({ uuid: uuid })
+                headers: {
+                    "Content-Type": "application/json",
+                    "X-Session-Token": sessionToken
+                },
+                body: JSON.stringify({ uuid: uuid, size: offset })
             });
             if (!finishResponse.ok) throw new Error("无法完成文件上传。");
 
@@ -600,6 +648,7 @@ document.addEventListener("DOMContentLoaded", () => {
             case "welcome":
                 const wasAlreadyConnected = myNickname !== "";
                 myNickname = msg.nickname;
+                sessionToken = msg.token;
                 sessionStorage.setItem("chat-nickname", myNickname);
                 nicknameInput.value = myNickname;
                 users = msg.users;
@@ -831,6 +880,40 @@ document.addEventListener("DOMContentLoaded", () => {
                 alert(msg.data);
                 nicknameInput.value = myNickname;
                 break;
+            // --- 新增：注册时的持钥证明，用私钥解密服务器下发的 nonce ---
+            case "challenge": {
+                const nonce = crypt.decrypt(msg.data);
+                ws.send(
+                    JSON.stringify({
+                        type: "challengeResponse",
+                        data: nonce || ""
+                    })
+                );
+                break;
+            }
+            case "registerError":
+                console.error("Registration rejected:", msg.data);
+                addSystemMessage(`注册失败: ${msg.data}`);
+                // 丢弃当前 ClientID，重连时以新会话注册
+                sessionStorage.removeItem("chat-clientID");
+                break;
+            case "kicked":
+                addSystemMessage(`你已被版主移出聊天室${msg.data ? ": " + msg.data : ""}`);
+                break;
+            case "banned":
+                addSystemMessage(msg.data || "你已被封禁");
+                break;
+            case "rateLimited":
+                addSystemMessage(msg.data);
+                break;
+            case "moderationError":
+                addSystemMessage(`操作失败: ${msg.data}`);
+                break;
+            case "moderation": {
+                const actions = { kick: "移出了", ban: "封禁了", unban: "解封了", mute: "禁言了", unmute: "解除禁言了" };
+                addSystemMessage(`${msg.moderator} ${actions[msg.action] || msg.action} ${msg.target}${msg.reason ? "（" + msg.reason + "）" : ""}`);
+                break;
+            }
         }
     }
 
@@ -873,7 +956,9 @@ document.addEventListener("DOMContentLoaded", () => {
                     iv: fileInfo.fileIV
                 };
 
-                const response = await fetch(`/download/${fileInfo.uuid}`);
+                const response = await fetch(`/download/${fileInfo.uuid}`, {
+                    headers: { "X-Session-Token": sessionToken }
+                });
                 if (!response.ok) throw new Error("下载加密文件失败。");
 
                 const decryptionStream = new TransformStream(
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+)
+
+// 话题与引用回复：消息可以带 replyTo 引用同一会话中的另一条消息，
+// 服务器据此把它归入被引用消息所在的话题（以话题首条消息的 ID 作为 threadID），
+// 并在每条回复之后向会话成员推送该话题的回复数。
+
+// threadStats counts the replies seen in one thread. Replies up to
+// SeededUpTo were counted from stored history and are not counted again.
+type threadStats struct {
+	Replies     int
+	LastReplyID int64
+	SeededUpTo  int64
+}
+
+// resolveReply checks msg.ReplyTo (or msg.ThreadID alone, meaning a reply to
+// the thread's root) against the conversation the message is going to and
+// returns the fields to relay. It reports the failure to the client and
+// returns ok=false when the target is unknown or belongs elsewhere.
+func (h *Hub) resolveReply(client *Client, msg Message, kind, room, peerID string) (replyTo, threadID int64, ok bool) {
+	replyTo = msg.ReplyTo
+	if replyTo == 0 {
+		replyTo = msg.ThreadID
+	}
+	if replyTo == 0 {
+		return 0, 0, true
+	}
+	route := h.lookupMessage(replyTo)
+	if route == nil {
+		rejectOperation(client, msg, errNotFound, "回复的消息不存在", nil)
+		return 0, 0, false
+	}
+	myID := client.clientID
+	same := route.Kind == kind
+	switch kind {
+	case historyConvRoom:
+		same = same && route.Room == room
+	case historyConvPrivate:
+		same = same && ((route.SenderID == myID && route.ToID == peerID) || (route.SenderID == peerID && route.ToID == myID))
+	}
+	if !same {
+		rejectOperation(client, msg, errInvalidRequest, "回复的消息不在此会话中", nil)
+		return 0, 0, false
+	}
+	threadID = route.ThreadID
+	if threadID == 0 {
+		threadID = route.ID
+	}
+	return replyTo, threadID, true
+}
+
+// storedReplies counts the replies to a thread that are still in stored
+// history, up to and including message upTo, and returns the last one's ID.
+// Deleted replies are not counted.
+func (h *Hub) storedReplies(threadID, upTo int64) (count int, lastReplyID int64) {
+	if h.history == nil {
+		return 0, 0
+	}
+	after := threadID
+	for {
+		entries, more, err := h.history.Query(HistoryQuery{
+			After: after, Limit: historyMaxLimit,
+			Matches: func(e *HistoryEntry) bool {
+				return e.Message.ThreadID == threadID && e.Message.ID <= upTo && !e.Message.Deleted
+			},
+		})
+		if err != nil {
+			log.Printf("Counting replies to thread %d failed: %v", threadID, err)
+			return count, lastReplyID
+		}
+		count += len(entries)
+		if len(entries) > 0 {
+			lastReplyID = entries[len(entries)-1].Message.ID
+		}
+		if !more || len(entries) == 0 {
+			return count, lastReplyID
+		}
+		after = lastReplyID
+	}
+}
+
+// noteThreadReply counts a relayed reply and pushes the thread's new reply
+// count to everyone in the conversation, the sender included. Call it after
+// the reply has been recorded in history.
+func (h *Hub) noteThreadReply(route *messageRoute) {
+	if route.ThreadID == 0 {
+		return
+	}
+	h.messagesMu.Lock()
+	_, known := h.threads[route.ThreadID]
+	h.messagesMu.Unlock()
+	seeded, seededUpTo := 1, int64(0)
+	if !known && h.history != nil {
+		// 重启后首次看到该话题时，从历史记录中补齐已有的回复数（包括这一条）
+		count, _ := h.storedReplies(route.ThreadID, route.ID)
+		seeded, seededUpTo = max(count, 1), route.ID
+	}
+
+	h.messagesMu.Lock()
+	stats, ok := h.threads[route.ThreadID]
+	switch {
+	case !ok:
+		stats = &threadStats{Replies: seeded, LastReplyID: route.ID, SeededUpTo: seededUpTo}
+		h.threads[route.ThreadID] = stats
+	case route.ID > stats.SeededUpTo:
+		stats.Replies++
+		if route.ID > stats.LastReplyID {
+			stats.LastReplyID = route.ID
+		}
+	}
+	replies, lastReplyID := stats.Replies, stats.LastReplyID
+	h.messagesMu.Unlock()
+
+	sendThreadUpdate(h.threadRecipients(route), route, replies, lastReplyID)
+}
+
+// noteThreadReplyDeleted takes a deleted reply out of its thread's count and
+// pushes the new count. Call it after the deletion has reached history.
+func (h *Hub) noteThreadReplyDeleted(route *messageRoute) {
+	if route.ThreadID == 0 {
+		return
+	}
+	h.messagesMu.Lock()
+	stats, known := h.threads[route.ThreadID]
+	lastReplyID := int64(0)
+	if known {
+		lastReplyID = stats.LastReplyID
+	}
+	h.messagesMu.Unlock()
+
+	// 未跟踪的话题，或删掉的正是最后一条回复时，从历史记录中重新统计
+	var stored int
+	var storedLast, storedUpTo int64
+	rescan := h.history != nil && (!known || lastReplyID == route.ID)
+	if rescan {
+		storedUpTo = atomic.LoadInt64(&h.lastMessageID)
+		stored, storedLast = h.storedReplies(route.ThreadID, storedUpTo)
+	}
+
+	h.messagesMu.Lock()
+	stats, known = h.threads[route.ThreadID]
+	switch {
+	case rescan:
+		if !known {
+			stats = &threadStats{}
+			h.threads[route.ThreadID] = stats
+		}
+		stats.Replies, stats.LastReplyID, stats.SeededUpTo = stored, storedLast, max(stats.SeededUpTo, storedUpTo)
+	case known:
+		stats.Replies = max(stats.Replies-1, 0)
+	default:
+		// 没有历史记录也不再跟踪该话题，无从得知剩余的回复数
+		h.messagesMu.Unlock()
+		return
+	}
+	replies, lastReplyID := stats.Replies, stats.LastReplyID
+	h.messagesMu.Unlock()
+
+	sendThreadUpdate(h.threadRecipients(route), route, replies, lastReplyID)
+}
+
+// threadRecipients returns the connected clients in the conversation a
+// thread belongs to.
+func (h *Hub) threadRecipients(route *messageRoute) []*Client {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var recipients []*Client
+	switch route.Kind {
+	case historyConvGroup:
+		for c := range h.clients {
+			recipients = append(recipients, c)
+		}
+	case historyConvRoom:
+		recipients = h.roomClientsLocked(route.Room)
+	case historyConvPrivate:
+		for _, id := range []string{route.SenderID, route.ToID} {
+			if session, ok := h.sessions[id]; ok && session.Client != nil {
+				recipients = append(recipients, session.Client)
+			}
+		}
+	}
+	return recipients
+}
+
+func sendThreadUpdate(recipients []*Client, route *messageRoute, replies int, lastReplyID int64) {
+	response := map[string]interface{}{
+		"type": "threadUpdate", "threadID": route.ThreadID, "replies": replies, "lastReplyID": lastReplyID,
+	}
+	if route.Room != "" {
+		response["room"] = route.Room
+	}
+	msgBytes, err := json.Marshal(response)
+	if err != nil {
+		return
+	}
+	for _, c := range recipients {
+		sendMessageToClient(c, msgBytes)
+	}
+}
+
+// handleThreadRequest 按页返回一个话题的首条消息和全部回复，只包含请求者可见的会话
+func (h *Hub) handleThreadRequest(client *Client, msg Message) {
+	if h.history == nil {
+		rejectOperation(client, msg, errUnavailable, "服务器未启用历史记录", map[string]string{"type": "historyError"})
+		return
+	}
+	if msg.ThreadID <= 0 {
+		rejectOperation(client, msg, errInvalidRequest, "缺少 threadID", map[string]string{"type": "historyError"})
+		return
+	}
+	visible := h.visibleTo(client)
+	matches := func(e *HistoryEntry) bool {
+		return (e.Message.ID == msg.ThreadID || e.Message.ThreadID == msg.ThreadID) && visible(e)
+	}
+	entries, more, err := h.history.Query(HistoryQuery{Before: msg.Before, After: msg.After, Limit: msg.Limit, Matches: matches})
+	if err != nil {
+		log.Printf("Thread query failed for %s: %v", client.nickname, err)
+		rejectOperation(client, msg, errInternal, "读取历史记录失败", map[string]string{"type": "historyError"})
+		return
+	}
+	items := make([]Message, 0, len(entries))
+	for _, e := range entries {
+		items = append(items, e.Message)
+	}
+	response := map[string]interface{}{"type": "thread", "threadID": msg.ThreadID, "messages": items, "hasMore": more}
+	if msgBytes, err := json.Marshal(response); err == nil {
+		sendMessageToClient(client, msgBytes)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HTTPS 支持：可以使用自备的证书和私钥，也可以在首次启动时为内网生成一个自签名 CA
+// 及由它签发的服务器证书并保存在 tlsDir 中。用户把 CA 导入浏览器或核对打印出的指纹即可。
+const (
+	selfSignedCAValidity     = 10 * 365 * 24 * time.Hour
+	selfSignedServerValidity = 397 * 24 * time.Hour // 浏览器接受的服务器证书最长有效期
+	selfSignedRenewBefore    = 30 * 24 * time.Hour
+)
+
+// selfSignedFiles returns where the generated CA and server certificate live inside dir.
+func selfSignedFiles(dir string) (caCert, caKey, serverCert, serverKey string) {
+	return filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"),
+		filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+}
+
+// ensureSelfSigned loads the CA and server certificate from dir, creating the
+// CA on first run (when neither of its files exists) and reissuing the server certificate when it is missing,
+// about to expire or no longer covers every host name. It returns the paths
+// to pass to ListenAndServeTLS.
+func ensureSelfSigned(dir string, extraHosts []string) (certFile, keyFile string, err error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+	caCertPath, caKeyPath, certFile, keyFile := selfSignedFiles(dir)
+
+	ca, caKey, err := loadKeyPair(caCertPath, caKeyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		// 只有证书和私钥都不存在时才生成新的 CA；只剩一个多半是误删或复制不全，
+		// 悄悄换掉 CA 会让已经导入旧 CA 的浏览器全部报错
+		_, certErr := os.Stat(caCertPath)
+		_, keyErr := os.Stat(caKeyPath)
+		if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+			log.Printf("Generating a self-signed CA in %s", dir)
+			ca, caKey, err = createCA(caCertPath, caKeyPath)
+		} else if errors.Is(certErr, os.ErrNotExist) != errors.Is(keyErr, os.ErrNotExist) {
+			err = fmt.Errorf("only one of %s and %s exists; restore the other or remove both to create a new CA", caCertPath, caKeyPath)
+		}
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("self-signed CA: %w", err)
+	}
+
+	hosts := certificateHosts(extraHosts)
+	server, _, err := loadKeyPair(certFile, keyFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return "", "", fmt.Errorf("server certificate: %w", err)
+	case server.CheckSignatureFrom(ca) != nil:
+		log.Printf("Server certificate in %s was not issued by the CA, reissuing it", dir)
+	case time.Until(server.NotAfter) < selfSignedRenewBefore:
+		log.Printf("Server certificate in %s expires %s, reissuing it", dir, server.NotAfter.Format(time.RFC3339))
+	case !coversHosts(server, hosts):
+		log.Printf("Server certificate in %s does not cover %s, reissuing it", dir, strings.Join(hosts, ", "))
+	default:
+		return certFile, keyFile, nil
+	}
+	if err := createServerCert(certFile, keyFile, ca, caKey, hosts); err != nil {
+		return "", "", fmt.Errorf("server certificate: %w", err)
+	}
+	return certFile, keyFile, nil
+}
+
+// certificateHosts lists the names and addresses clients on the intranet may use to reach the server.
+func certificateHosts(extra []string) []string {
+	seen := make(map[string]bool)
+	var hosts []string
+	add := func(h string) {
+		h = strings.TrimSpace(h)
+		if h != "" && !seen[h] {
+			seen[h] = true
+			hosts = append(hosts, h)
+		}
+	}
+	add("localhost")
+	if name, err := os.Hostname(); err == nil {
+		add(name)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				add(ipNet.IP.String())
+			}
+		}
+	}
+	for _, h := range extra {
+		add(h)
+	}
+	return hosts
+}
+
+func coversHosts(cert *x509.Certificate, hosts []string) bool {
+	for _, h := range hosts {
+		if cert.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func loadCertificate(path string) (*x509.Certificate, error) {
+	certPEM, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s is not a PEM certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func loadKeyPair(certPath, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	cert, err := loadCertificate(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("%s is not a PEM private key", keyPath)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func createCA(certPath, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "Intranet Chatroom CA", Organization: []string{"Intranet Chatroom"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeKeyPair(certPath, keyPath, der, key); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+func createServerCert(certPath, keyPath string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: hosts[0], Organization: []string{"Intranet Chatroom"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(selfSignedServerValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	log.Printf("Issued server certificate for %s", strings.Join(hosts, ", "))
+	return writeKeyPair(certPath, keyPath, der, key)
+}
+
+func writeKeyPair(certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err)
+	}
+	return serial
+}
+
+// certFingerprint formats the SHA-256 of a certificate the way browsers show it, e.g. "AB:CD:...".
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// logCertificateFingerprints prints the fingerprint of every certificate in the
+// chain so users can compare it with what their browser reports.
+func logCertificateFingerprints(certFile, keyFile, caFile string) error {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	for i, der := range pair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		label := "Server certificate"
+		if i > 0 {
+			label = "Intermediate certificate"
+		}
+		log.Printf("%s %q (expires %s) SHA-256 fingerprint: %s",
+			label, cert.Subject.CommonName, cert.NotAfter.Format("2006-01-02"), certFingerprint(der))
+	}
+	if caFile != "" {
+		ca, err := loadCertificate(caFile)
+		if err != nil {
+			return err
+		}
+		log.Printf("CA certificate %q SHA-256 fingerprint: %s (import %s into browsers to trust the server)",
+			ca.Subject.CommonName, certFingerprint(ca.Raw), caFile)
+	}
+	return nil
+}
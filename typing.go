@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// 输入状态指示：服务器负责限流，并在超时或断线时自动补发 typingStop
+const (
+	typingMinInterval = 2 * time.Second // 同一目标的 typingStart 最多每 2 秒转发一次
+	typingTimeout     = 6 * time.Second // 未续期的输入状态在 6 秒后自动结束
+)
+
+// typingTarget identifies the conversation a client is typing in:
+// a nickname for private chats, a room name, or neither for the global group.
+type typingTarget struct {
+	To   string
+	Room string
+}
+
+type typingState struct {
+	target    typingTarget
+	timer     *time.Timer
+	relayedAt time.Time
+}
+
+func typingTargetOf(msg Message) typingTarget {
+	if msg.Room != "" {
+		return typingTarget{Room: msg.Room}
+	}
+	if msg.To == groupRecipient {
+		return typingTarget{}
+	}
+	return typingTarget{To: msg.To}
+}
+
+func (h *Hub) handleTypingStart(client *Client, msg Message) {
+	target := typingTargetOf(msg)
+	if target.Room != "" && !h.isRoomMember(target.Room, client) {
+		sendError(client, msg, errForbidden, "你不在该房间中")
+		return
+	}
+
+	h.mutex.Lock()
+	if target.To != "" {
+		if _, ok := h.nicknames[target.To]; !ok || target.To == client.nickname {
+			h.mutex.Unlock()
+			sendError(client, msg, errNotFound, "用户不在线")
+			return
+		}
+	}
+	now := time.Now()
+	var previous *typingState
+	if state := client.typing; state != nil && state.target != target {
+		// 换了会话，先结束旧会话中的输入状态
+		previous = clearTypingLocked(client)
+	}
+	if state := client.typing; state != nil {
+		state.timer.Reset(typingTimeout)
+		if now.Sub(state.relayedAt) < typingMinInterval {
+			h.mutex.Unlock()
+			return
+		}
+		state.relayedAt = now
+	} else {
+		state := &typingState{target: target, relayedAt: now}
+		state.timer = time.AfterFunc(typingTimeout, func() { h.expireTyping(client, state) })
+		client.typing = state
+	}
+	nickname := client.nickname
+	h.mutex.Unlock()
+
+	if previous != nil {
+		h.relayTyping(client, nickname, "typingStop", previous.target)
+	}
+	h.relayTyping(client, nickname, "typingStart", target)
+}
+
+func (h *Hub) handleTypingStop(client *Client) {
+	h.mutex.Lock()
+	state := clearTypingLocked(client)
+	nickname := client.nickname
+	h.mutex.Unlock()
+	if state != nil {
+		h.relayTyping(client, nickname, "typingStop", state.target)
+	}
+}
+
+// expireTyping emits typingStop when the client stopped renewing its typing state.
+func (h *Hub) expireTyping(client *Client, state *typingState) {
+	h.mutex.Lock()
+	if client.typing != state {
+		h.mutex.Unlock()
+		return
+	}
+	clearTypingLocked(client)
+	nickname := client.nickname
+	h.mutex.Unlock()
+	h.relayTyping(client, nickname, "typingStop", state.target)
+}
+
+// clearTypingLocked resets the client's typing state and returns what was
+// cleared, or nil if it was not typing. Caller must hold mutex.
+func clearTypingLocked(client *Client) *typingState {
+	state := client.typing
+	if state == nil {
+		return nil
+	}
+	state.timer.Stop()
+	client.typing = nil
+	return state
+}
+
+func (h *Hub) relayTyping(client *Client, nickname, eventType string, target typingTarget) {
+	response := Message{Type: eventType, From: nickname, Room: target.Room}
+	if target.Room == "" && target.To == "" {
+		response.To = groupRecipient
+	}
+	msgBytes, err := json.Marshal(response)
+	if err != nil {
+		return
+	}
+	h.metrics.countRelayed(eventType)
+
+	switch {
+	case target.Room != "":
+		h.broadcastToRoom(target.Room, msgBytes, client)
+	case target.To != "":
+		h.mutex.Lock()
+		recipient, ok := h.nicknames[target.To]
+		h.mutex.Unlock()
+		if ok {
+			sendMessageToClient(recipient, msgBytes)
+		}
+	default:
+		h.broadcastMessage(msgBytes, client)
+	}
+}
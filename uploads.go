@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/hex"
+	"time"
+)
+
+// Upload tracks a chunked upload from /upload/start until its file is shared.
+type Upload struct {
+	UUID         string
+	Owner        string // ClientID of the uploading session
+	CreatedAt    time.Time
+	LastActivity time.Time // Last chunk written, used by the janitor
+	FinishedAt   time.Time
+	Committed    int64 // Bytes written so far; the next chunk must start here
+	Finished     bool
+	writing      bool // A chunk is currently being written
+}
+
+// isValidUUID 只接受 handleUploadStart 生成的 32 位十六进制 UUID，防止路径穿越
+func isValidUUID(uuid string) bool {
+	if len(uuid) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(uuid)
+	return err == nil
+}
+
+// ownedUploadLocked returns the upload if it belongs to the given ClientID. Caller must hold filesMu.
+func (h *Hub) ownedUploadLocked(uuid, clientID string) (*Upload, bool) {
+	upload, ok := h.uploads[uuid]
+	if !ok || upload.Owner != clientID {
+		return nil, false
+	}
+	return upload, true
+}
+
+// canAccessFileLocked 判断调用者是否为文件的上传者、某条引用的发送者/接收者，
+// 或被分享到的群聊/房间的成员。Caller must hold mutex and filesMu.
+func (h *Hub) canAccessFileLocked(uuid string, info *FileInfo, who requester) bool {
+	if upload, ok := h.uploads[uuid]; ok && upload.Owner == who.ClientID {
+		return true
+	}
+	if info == nil {
+		return false
+	}
+	for _, ref := range info.References {
+		switch {
+		case ref.SenderID == who.ClientID || (ref.RecipientID != "" && ref.RecipientID == who.ClientID):
+			return true
+		case ref.Group:
+			return true
+		case ref.Room != "":
+			if room, ok := h.rooms[ref.Room]; ok && room.Members[who.ClientID] {
+				return true
+			}
+		}
+	}
+	return false
+}